@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+//限流算法:固定窗口(默认)
+const algorithmFixedWindow = "fixed-window"
+
+//限流算法:滑动窗口计数，使用上一个窗口的加权计数与当前窗口计数之和
+const algorithmSlidingWindowCounter = "sliding-window-counter"
+
+//限流算法:滑动窗口日志，使用有序集合记录每个请求的时间戳
+const algorithmSlidingWindowLog = "sliding-window-log"
+
+//限流算法:令牌桶，按补充周期补充令牌，允许不超过桶容量的突发请求
+const algorithmTokenBucket = "token-bucket"
+
+//限流算法:GCRA(通用信元速率算法)，每个标识只保存一个理论到达时间，内存占用固定
+const algorithmGCRA = "gcra"
+
+//固定窗口lua脚本，每个窗口一个key，第一次执行才设置有效期，如果过了有效期，则为下一时间段,使用lua保证原子性
+const fixedWindowScript = `
+		local usages = {}
+		for i, key in ipairs(KEYS) do
+			local newVal = redis.call("incrby", key, 1)
+			if newVal == 1 then
+				redis.call("expire", key, ARGV[i])
+			end
+			usages[i] = newVal - 1
+		end
+		return usages
+`
+
+//滑动窗口计数lua脚本，估算值=上一窗口计数*上一窗口在滑动窗口中所占比例+当前窗口计数，所有窗口都未超限时才计数
+const slidingWindowCounterScript = `
+		local estimates, exceeded = {}, false
+		for i = 1, #KEYS / 2 do
+			local current = tonumber(redis.call("get", KEYS[2 * i - 1]) or "0")
+			local previous = tonumber(redis.call("get", KEYS[2 * i]) or "0")
+			estimates[i] = math.floor(previous * tonumber(ARGV[3 * i - 1])) + current
+			if estimates[i] >= tonumber(ARGV[3 * i - 2]) then
+				exceeded = true
+			end
+		end
+		if not exceeded then
+			for i = 1, #KEYS / 2 do
+				if redis.call("incr", KEYS[2 * i - 1]) == 1 then
+					redis.call("expire", KEYS[2 * i - 1], ARGV[3 * i])
+				end
+			end
+		end
+		return estimates
+`
+
+//滑动窗口日志lua脚本，所有窗口共用一个有序集合，先清理最大窗口外的请求记录，所有窗口都未超限时才记录本次请求
+//注意:有序集合会保存最大窗口内的所有请求，不建议用于天、月等大窗口
+const slidingWindowLogScript = `
+		local key, now, member = KEYS[1], tonumber(ARGV[1]), ARGV[2]
+		local result, maxWindow, exceeded = {}, 0, false
+		for i = 3, #ARGV, 2 do
+			maxWindow = math.max(maxWindow, tonumber(ARGV[i + 1]))
+		end
+		redis.call("zremrangebyscore", key, "-inf", now - maxWindow)
+		for i = 3, #ARGV, 2 do
+			local limit, min = tonumber(ARGV[i]), "(" .. (now - tonumber(ARGV[i + 1]))
+			local count = redis.call("zcount", key, min, "+inf")
+			local oldest = redis.call("zrangebyscore", key, min, "+inf", "withscores", "limit", 0, 1)
+			if count >= limit then
+				exceeded = true
+			end
+			table.insert(result, count)
+			table.insert(result, tonumber(oldest[2] or now))
+		end
+		if not exceeded then
+			redis.call("zadd", key, now, member)
+		end
+		redis.call("pexpire", key, maxWindow)
+		return result
+`
+
+//令牌桶lua脚本，令牌数和上次补充时间保存在同一个hash中，返回{是否放行, 剩余令牌数, 距离下次补充令牌的毫秒数}
+const tokenBucketScript = `
+		local key = KEYS[1]
+		local rate, burst, interval, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+		local bucket = redis.call("hmget", key, "tokens", "ts")
+		local tokens, ts = tonumber(bucket[1]), tonumber(bucket[2])
+		if tokens == nil or ts == nil then
+			tokens, ts = burst, now
+		end
+		local periods = math.floor((now - ts) / interval)
+		if periods > 0 then
+			tokens = math.min(burst, tokens + periods * rate)
+			ts = ts + periods * interval
+		end
+		local allowed = 0
+		if tokens > 0 then
+			tokens = tokens - 1
+			allowed = 1
+		end
+		redis.call("hmset", key, "tokens", tokens, "ts", ts)
+		redis.call("pexpire", key, math.ceil(burst / rate) * interval + interval)
+		return {allowed, tokens, math.max(0, ts + interval - now)}
+`
+
+//GCRA lua脚本，只保存理论到达时间(TAT，微秒)，返回{是否放行, 剩余数量, 被限流时为重试等待微秒数否则为完全恢复的微秒数}
+const gcraScript = `
+		local key = KEYS[1]
+		local emission, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+		local tat = tonumber(redis.call("get", key) or now)
+		if tat < now then
+			tat = now
+		end
+		local newTat = tat + emission
+		local allowAt = newTat - burst * emission
+		if now < allowAt then
+			return {0, 0, allowAt - now}
+		end
+		redis.call("set", key, string.format("%.0f", newTat), "px", math.ceil((newTat - now) / 1000))
+		return {1, math.floor((now - allowAt) / emission), newTat - now}
+`
+
+//限流结果
+type limitResult struct {
+	window    limitWindow   //结果对应的窗口，多个窗口时为最紧张的窗口
+	remaining int           //剩余可用数量
+	reset     time.Duration //距离窗口重置或下一个令牌可用的时间
+	stop      bool          //是否需要限流
+}
+
+//获取当前算法对应的lua脚本、key及参数
+func (conf Config) getAlgorithmScript(identifier string, windows []limitWindow, now time.Time) (script string, keys []string, args []interface{}) {
+	switch conf.Algorithm {
+	case algorithmSlidingWindowCounter:
+		for _, window := range windows {
+			//上一窗口在滑动窗口中所占的比例
+			elapsed := float64(now.Sub(window.start)) / float64(window.duration())
+			weight := strconv.FormatFloat(1-elapsed, 'f', 3, 64)
+			keys = append(keys,
+				conf.getWindowRateLimitKey(identifier, window.name, window.start.Unix()),
+				conf.getWindowRateLimitKey(identifier, window.name, window.previousStart().Unix()))
+			//当前窗口的计数在下一个窗口中还要作为上一窗口使用，所以多保留一个窗口
+			args = append(args, window.limit, weight, ceilSeconds(window.end.Sub(now)+window.duration()))
+		}
+		return slidingWindowCounterScript, keys, args
+	case algorithmSlidingWindowLog:
+		//同一毫秒内可能有多个请求，加上随机数避免有序集合成员重复
+		member := strconv.FormatInt(now.UnixNano(), 10) + "-" + strconv.FormatInt(rand.Int63(), 36)
+		keys = []string{conf.getRateLimitKey(identifier, now.Unix())}
+		args = []interface{}{toMillisecond(now), member}
+		for _, window := range windows {
+			args = append(args, window.limit, int64(window.duration()/time.Millisecond))
+		}
+		return slidingWindowLogScript, keys, args
+	case algorithmTokenBucket:
+		rate, burst, interval := conf.getTokenBucketParams()
+		keys = []string{conf.getRateLimitKey(identifier, now.Unix())}
+		return tokenBucketScript, keys, []interface{}{rate, burst, int64(interval / time.Millisecond), toMillisecond(now)}
+	case algorithmGCRA:
+		//每个请求的发送间隔，最小为1微秒，否则tat不会增加(本地计数会除以0)，即每个补充周期最多允许interval微秒个请求
+		rate, burst, interval := conf.getTokenBucketParams()
+		emission := int64(interval/time.Microsecond) / int64(rate)
+		if emission < 1 {
+			emission = 1
+		}
+		keys = []string{conf.getRateLimitKey(identifier, now.Unix())}
+		return gcraScript, keys, []interface{}{emission, burst, now.UnixNano() / int64(time.Microsecond)}
+	default:
+		for _, window := range windows {
+			keys = append(keys, conf.getWindowRateLimitKey(identifier, window.name, window.start.Unix()))
+			args = append(args, ceilSeconds(window.end.Sub(now)))
+		}
+		return fixedWindowScript, keys, args
+	}
+}
+
+//解析lua脚本的返回值，多个窗口时返回最紧张的窗口
+func (conf Config) parseAlgorithmResult(reply interface{}, windows []limitWindow, now time.Time) (result limitResult, err error) {
+	var results []limitResult
+	switch conf.Algorithm {
+	case algorithmSlidingWindowLog:
+		values, err := parseInt64Slice(reply, 2*len(windows))
+		if err != nil {
+			return result, err
+		}
+		for i, window := range windows {
+			//窗口内最早的一条记录移出窗口后，才有新的可用数量
+			reset := time.Duration(values[2*i+1]-toMillisecond(now))*time.Millisecond + window.duration()
+			results = append(results, window.getUsageResult(values[2*i], reset))
+		}
+	case algorithmTokenBucket:
+		values, err := parseInt64Slice(reply, 3)
+		if err != nil {
+			return result, err
+		}
+		rate, _, interval := conf.getTokenBucketParams()
+		result.window = getTokenBucketWindow(rate, interval)
+		result.stop = values[0] == 0
+		result.remaining = int(values[1])
+		result.reset = time.Duration(values[2]) * time.Millisecond
+		return result, nil
+	case algorithmGCRA:
+		values, err := parseInt64Slice(reply, 3)
+		if err != nil {
+			return result, err
+		}
+		rate, _, interval := conf.getTokenBucketParams()
+		result.window = getTokenBucketWindow(rate, interval)
+		result.stop = values[0] == 0
+		result.remaining = int(values[1])
+		result.reset = time.Duration(values[2]) * time.Microsecond
+		return result, nil
+	default:
+		values, err := parseInt64Slice(reply, len(windows))
+		if err != nil {
+			return result, err
+		}
+		for i, window := range windows {
+			results = append(results, window.getUsageResult(values[i], window.end.Sub(now)))
+		}
+	}
+	return mergeLimitResults(results), nil
+}
+
+//令牌桶及GCRA返回给客户端的窗口，补充周期为1秒时沿用QPS，为1分钟、1小时、1天时使用对应窗口，
+//其他周期使用秒数作为窗口名称，如X-Rate-Limiting-Limit-90s
+func getTokenBucketWindow(rate int, interval time.Duration) limitWindow {
+	name := strconv.FormatInt(int64(interval/time.Second), 10) + "s"
+	switch interval {
+	case time.Second:
+		name = windowSecond
+	case time.Minute:
+		name = windowMinute
+	case time.Hour:
+		name = windowHour
+	case 24 * time.Hour:
+		name = windowDay
+	}
+	return limitWindow{name: name, limit: rate}
+}
+
+//获取令牌桶及GCRA参数:每个周期补充的令牌数、桶容量、补充周期
+func (conf Config) getTokenBucketParams() (rate int, burst int, interval time.Duration) {
+	rate = conf.Rate
+	if rate == 0 {
+		rate = conf.getSecondLimit()
+	}
+	burst = conf.Burst
+	if burst == 0 {
+		burst = rate
+	}
+	interval = time.Second
+	if conf.RefillIntervalSecond > 0 {
+		interval = time.Duration(conf.RefillIntervalSecond) * time.Second
+	}
+	return rate, burst, interval
+}
+
+//转换为毫秒时间戳
+func toMillisecond(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+//将lua脚本返回的数组转换为[]int64
+func parseInt64Slice(reply interface{}, length int) ([]int64, error) {
+	list, ok := reply.([]interface{})
+	if !ok || len(list) != length {
+		return nil, errors.New(fmt.Sprintf("unexpected redis eval result: %v", reply))
+	}
+	values := make([]int64, length)
+	for i, item := range list {
+		value, ok := item.(int64)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("unexpected redis eval result: %v", reply))
+		}
+		values[i] = value
+	}
+	return values, nil
+}
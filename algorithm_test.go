@@ -0,0 +1,201 @@
+package main
+
+import (
+	"github.com/Kong/go-pdk"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGetRateLimitKeyWithAlgorithm(t *testing.T) {
+	list := []struct {
+		algorithm string
+		expected  string
+	}{
+		{
+			algorithm: "",
+			expected:  "nicktest:kong:customratelimit:username-nick:qps:1600067356",
+		},
+		{
+			algorithm: algorithmFixedWindow,
+			expected:  "nicktest:kong:customratelimit:username-nick:qps:1600067356",
+		},
+		{
+			algorithm: algorithmSlidingWindowCounter,
+			expected:  "nicktest:kong:customratelimit:username-nick:qps:swc:1600067356",
+		},
+		{
+			algorithm: algorithmSlidingWindowLog,
+			expected:  "nicktest:kong:customratelimit:username-nick:qps:swl",
+		},
+		{
+			algorithm: algorithmTokenBucket,
+			expected:  "nicktest:kong:customratelimit:username-nick:qps:tb",
+		},
+		{
+			algorithm: algorithmGCRA,
+			expected:  "nicktest:kong:customratelimit:username-nick:qps:gcra",
+		},
+	}
+	for _, val := range list {
+		conf := getDefaultConf()
+		conf.Algorithm = val.algorithm
+		actual := conf.getRateLimitKey("username-nick", 1600067356)
+		if actual != val.expected {
+			t.Errorf("getRateLimitKey with algorithm [%s] return: [%s], expected: [%s]", val.algorithm, actual, val.expected)
+		}
+	}
+}
+
+func TestGetRemainingAndIncrWithAlgorithm(t *testing.T) {
+	kong := &pdk.PDK{}
+	now := time.Now()
+	for _, algorithm := range []string{algorithmFixedWindow, algorithmSlidingWindowCounter, algorithmSlidingWindowLog, algorithmTokenBucket, algorithmGCRA} {
+		conf := getDefaultConf()
+		conf.QPS = 3
+		conf.Algorithm = algorithm
+		identifier := "algorithm-" + strconv.FormatInt(now.UnixNano(), 10)
+		expected := []struct {
+			remaining int
+			stop      bool
+		}{
+			{2, false},
+			{1, false},
+			{0, false},
+			{0, true},
+			{0, true},
+		}
+		for i, val := range expected {
+			result, err := conf.getRemainingAndIncr(kong, identifier, now)
+			if err != nil {
+				t.Fatalf("getRemainingAndIncr with algorithm [%s] failed, %s", algorithm, err.Error())
+			}
+			if result.remaining != val.remaining || result.stop != val.stop {
+				t.Errorf("getRemainingAndIncr with algorithm [%s] request %d return: [%v %v], expected: [%v %v]", algorithm, i, result.remaining, result.stop, val.remaining, val.stop)
+			}
+		}
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	kong := &pdk.PDK{}
+	conf := getDefaultConf()
+	conf.Algorithm = algorithmTokenBucket
+	conf.Rate = 1
+	conf.Burst = 2
+	conf.RefillIntervalSecond = 2
+	now := time.Now()
+	identifier := "token-bucket-" + strconv.FormatInt(now.UnixNano(), 10)
+	expected := []struct {
+		after     time.Duration
+		remaining int
+		reset     time.Duration
+		stop      bool
+	}{
+		{0, 1, 2 * time.Second, false},
+		{500 * time.Millisecond, 0, 1500 * time.Millisecond, false},
+		{time.Second, 0, time.Second, true},
+		//补充一个令牌
+		{2 * time.Second, 0, 2 * time.Second, false},
+		//桶容量为2，最多只能补满2个令牌
+		{10 * time.Second, 1, 2 * time.Second, false},
+	}
+	for i, val := range expected {
+		result, err := conf.getRemainingAndIncr(kong, identifier, now.Add(val.after))
+		if err != nil {
+			t.Fatalf("getRemainingAndIncr with token bucket failed, %s", err.Error())
+		}
+		if result.remaining != val.remaining || result.reset != val.reset || result.stop != val.stop {
+			t.Errorf("getRemainingAndIncr with token bucket request %d return: [%v %v %v], expected: [%v %v %v]", i, result.remaining, result.reset, result.stop, val.remaining, val.reset, val.stop)
+		}
+	}
+}
+
+func TestGCRARetryAfter(t *testing.T) {
+	kong := &pdk.PDK{}
+	conf := getDefaultConf()
+	conf.Algorithm = algorithmGCRA
+	conf.Rate = 2
+	conf.Burst = 2
+	now := time.Now()
+	identifier := "gcra-" + strconv.FormatInt(now.UnixNano(), 10)
+	expected := []struct {
+		after     time.Duration
+		remaining int
+		reset     time.Duration
+		stop      bool
+	}{
+		{0, 1, 500 * time.Millisecond, false},
+		{0, 0, time.Second, false},
+		//每500毫秒恢复一个
+		{100 * time.Millisecond, 0, 400 * time.Millisecond, true},
+		{500 * time.Millisecond, 0, time.Second, false},
+		{3 * time.Second, 1, 500 * time.Millisecond, false},
+	}
+	for i, val := range expected {
+		result, err := conf.getRemainingAndIncr(kong, identifier, now.Add(val.after))
+		if err != nil {
+			t.Fatalf("getRemainingAndIncr with gcra failed, %s", err.Error())
+		}
+		if result.remaining != val.remaining || result.reset != val.reset || result.stop != val.stop {
+			t.Errorf("getRemainingAndIncr with gcra request %d return: [%v %v %v], expected: [%v %v %v]", i, result.remaining, result.reset, result.stop, val.remaining, val.reset, val.stop)
+		}
+	}
+}
+
+func TestGetTokenBucketParams(t *testing.T) {
+	conf := getDefaultConf()
+	rate, burst, interval := conf.getTokenBucketParams()
+	if rate != 30 || burst != 30 || interval != time.Second {
+		t.Errorf("getTokenBucketParams return: [%v %v %v], expected: [%v %v %v]", rate, burst, interval, 30, 30, time.Second)
+	}
+	conf.Rate = 5
+	conf.Burst = 50
+	conf.RefillIntervalSecond = 10
+	rate, burst, interval = conf.getTokenBucketParams()
+	if rate != 5 || burst != 50 || interval != 10*time.Second {
+		t.Errorf("getTokenBucketParams return: [%v %v %v], expected: [%v %v %v]", rate, burst, interval, 5, 50, 10*time.Second)
+	}
+}
+
+func TestGetTokenBucketWindow(t *testing.T) {
+	list := []struct {
+		interval time.Duration
+		expected string
+	}{
+		{time.Second, "X-Rate-Limiting-Limit-QPS"},
+		{time.Minute, "X-Rate-Limiting-Limit-Minute"},
+		{time.Hour, "X-Rate-Limiting-Limit-Hour"},
+		{24 * time.Hour, "X-Rate-Limiting-Limit-Day"},
+		{90 * time.Second, "X-Rate-Limiting-Limit-90s"},
+	}
+	for _, val := range list {
+		window := getTokenBucketWindow(100, val.interval)
+		if header := window.limitHeader(); header != val.expected || window.limit != 100 {
+			t.Errorf("getTokenBucketWindow [%v] return: [%s %d], expected: [%s %d]", val.interval, header, window.limit, val.expected, 100)
+		}
+	}
+}
+
+//每个补充周期的请求数超过周期的微秒数时，发送间隔最小为1微秒
+func TestGCRAWithLargeRate(t *testing.T) {
+	kong := &pdk.PDK{}
+	now := time.Now()
+	for _, policy := range []string{"", policyLocal} {
+		conf := getDefaultConf()
+		conf.Algorithm = algorithmGCRA
+		conf.Policy = policy
+		conf.Rate = 2000000
+		conf.Burst = 1
+		identifier := "gcra-large-" + policy + strconv.FormatInt(now.UnixNano(), 10)
+		for i, stop := range []bool{false, true} {
+			result, err := conf.getRemainingAndIncr(kong, identifier, now)
+			if err != nil {
+				t.Fatalf("getRemainingAndIncr with policy [%s] failed, %s", policy, err.Error())
+			}
+			if result.stop != stop {
+				t.Errorf("getRemainingAndIncr with policy [%s] request %d return stop: [%v], expected: [%v]", policy, i, result.stop, stop)
+			}
+		}
+	}
+}
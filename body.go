@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Kong/go-pdk"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//multipart body中读取非文件字段的默认最大字节数
+const defaultMultipartMaxBytes = 1 << 20
+
+//multipart body超过MultipartMaxBytes时的处理:按规则匹配，使用固定的限流key(默认)
+const multipartTooLargeMatch = "match"
+
+//multipart body超过MultipartMaxBytes时的处理:拒绝请求，返回413
+const multipartTooLargeDeny = "deny"
+
+//multipart body超过MultipartMaxBytes时使用的限流key，超限的请求共用一个计数
+const multipartTooLargeKey = "multipart-too-large"
+
+//multipart body超过MultipartMaxBytes，不能读取字段的值
+var errMultipartTooLarge = errors.New("multipart fields exceed MultipartMaxBytes")
+
+//json路径中的一段，name为对象的字段，indexes为数组下标，-1表示[*]匹配所有元素
+type jsonPathSegment struct {
+	name    string
+	indexes []int
+}
+
+//获取请求body中key对应的值，根据Content-Type解码body
+func (conf Config) getBodyValues(kong *pdk.PDK, key string) ([]string, error) {
+	//没有Content-Type时按x-www-form-urlencoded解析
+	contentType, err := kong.Request.GetHeader("Content-Type")
+	if err != nil {
+		contentType = ""
+	}
+	//multipart body可能包含大文件，超过限制时不通过pdk读取和解析body(kong已缓冲body)，按MultipartTooLarge处理
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "multipart/form-data" && conf.isBodyTooLarge(kong) {
+		return nil, errMultipartTooLarge
+	}
+	rawBody, err := kong.Request.GetRawBody()
+	if err != nil {
+		return nil, err
+	}
+	return conf.parseBodyValues(contentType, rawBody, key)
+}
+
+//Content-Length是否超过MultipartMaxBytes，没有Content-Length(如chunked)时在解析时限制非文件字段
+func (conf Config) isBodyTooLarge(kong *pdk.PDK) bool {
+	contentLength, err := kong.Request.GetHeader("Content-Length")
+	if err != nil {
+		return false
+	}
+	length, err := strconv.ParseInt(strings.TrimSpace(contentLength), 10, 64)
+	return err == nil && length > conf.getMultipartMaxBytes()
+}
+
+//解码body并返回key对应的值，json使用JSONPath或点号路径(如order.items[0].sku)，multipart使用非文件字段名，其他格式按x-www-form-urlencoded解析
+func (conf Config) parseBodyValues(contentType string, rawBody string, key string) ([]string, error) {
+	if rawBody == "" {
+		return nil, nil
+	}
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		return getJsonValues(rawBody, key)
+	}
+	if mediaType == "multipart/form-data" {
+		return getMultipartValues(rawBody, params["boundary"], key, conf.getMultipartMaxBytes())
+	}
+	//部分字段格式错误时，仍使用其他已解析的字段
+	values, _ := url.ParseQuery(rawBody)
+	return values[key], nil
+}
+
+//获取multipart读取非文件字段的最大字节数
+func (conf Config) getMultipartMaxBytes() int64 {
+	if conf.MultipartMaxBytes > 0 {
+		return int64(conf.MultipartMaxBytes)
+	}
+	return defaultMultipartMaxBytes
+}
+
+//解析multipart body并返回字段名为key的值，跳过文件，非文件字段累计超过maxBytes时返回错误
+func getMultipartValues(rawBody string, boundary string, key string, maxBytes int64) ([]string, error) {
+	if boundary == "" {
+		return nil, errors.New("multipart body without boundary")
+	}
+	reader := multipart.NewReader(strings.NewReader(rawBody), boundary)
+	var findList []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return findList, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		//文件内容不读取，NextPart时直接跳过
+		if part.FileName() != "" {
+			continue
+		}
+		//多读一个字节用于判断是否超过限制
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		maxBytes -= int64(len(value))
+		if maxBytes < 0 {
+			return nil, errMultipartTooLarge
+		}
+		if part.FormName() == key {
+			findList = append(findList, string(value))
+		}
+	}
+}
+
+//解析json body并按路径查找值
+func getJsonValues(rawBody string, path string) ([]string, error) {
+	segments, err := parseJsonPath(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(rawBody)))
+	//保留数字的原始精度
+	decoder.UseNumber()
+	var data interface{}
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	var findList []string
+	for _, node := range selectJsonNodes([]interface{}{data}, segments) {
+		findList = append(findList, jsonScalarValues(node)...)
+	}
+	return findList, nil
+}
+
+//解析路径，支持$.a.b[0].c、a.b[*].c、a['b.c']等写法
+func parseJsonPath(path string) ([]jsonPathSegment, error) {
+	path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+	var segments []jsonPathSegment
+	for i := 0; i < len(path); {
+		switch path[i] {
+		case '.':
+			i++
+			end := i
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				end++
+			}
+			if end == i {
+				return nil, errors.New(fmt.Sprintf("invalid json path %s", path))
+			}
+			segments = append(segments, jsonPathSegment{name: path[i:end]})
+			i = end
+		case '[':
+			end := strings.Index(path[i:], "]")
+			if end < 0 {
+				return nil, errors.New(fmt.Sprintf("invalid json path %s", path))
+			}
+			inner := path[i+1 : i+end]
+			i += end + 1
+			if len(inner) > 1 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				segments = append(segments, jsonPathSegment{name: inner[1 : len(inner)-1]})
+				continue
+			}
+			index := -1
+			if inner != "*" {
+				parsed, err := strconv.Atoi(inner)
+				if err != nil || parsed < 0 {
+					return nil, errors.New(fmt.Sprintf("invalid json path %s", path))
+				}
+				index = parsed
+			}
+			if len(segments) == 0 {
+				segments = append(segments, jsonPathSegment{})
+			}
+			last := &segments[len(segments)-1]
+			last.indexes = append(last.indexes, index)
+		default:
+			//没有以$或.开头的第一段
+			end := i
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				end++
+			}
+			segments = append(segments, jsonPathSegment{name: path[i:end]})
+			i = end
+		}
+	}
+	return segments, nil
+}
+
+//按路径逐段查找节点，name为空表示当前节点本身
+func selectJsonNodes(nodes []interface{}, segments []jsonPathSegment) []interface{} {
+	for _, segment := range segments {
+		var next []interface{}
+		for _, node := range nodes {
+			if segment.name != "" {
+				object, ok := node.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if node, ok = object[segment.name]; !ok {
+					continue
+				}
+			}
+			next = append(next, selectJsonIndexes(node, segment.indexes)...)
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+//按数组下标查找节点
+func selectJsonIndexes(node interface{}, indexes []int) []interface{} {
+	nodes := []interface{}{node}
+	for _, index := range indexes {
+		var next []interface{}
+		for _, node := range nodes {
+			array, ok := node.([]interface{})
+			if !ok {
+				continue
+			}
+			if index < 0 {
+				next = append(next, array...)
+			} else if index < len(array) {
+				next = append(next, array[index])
+			}
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+//将json的值转换为字符串用于匹配，数字统一格式(1.0和1相等)，数组展开为每个元素，对象及null忽略
+func jsonScalarValues(node interface{}) []string {
+	switch value := node.(type) {
+	case string:
+		return []string{value}
+	case bool:
+		return []string{strconv.FormatBool(value)}
+	case json.Number:
+		if number, err := value.Int64(); err == nil {
+			return []string{strconv.FormatInt(number, 10)}
+		}
+		//超出int64的整数保留原始值，避免丢失精度
+		if number, err := value.Float64(); err == nil && strings.ContainsAny(value.String(), ".eE") {
+			return []string{strconv.FormatFloat(number, 'f', -1, 64)}
+		}
+		return []string{value.String()}
+	case []interface{}:
+		var findList []string
+		for _, item := range value {
+			switch item.(type) {
+			case []interface{}, map[string]interface{}:
+				continue
+			}
+			findList = append(findList, jsonScalarValues(item)...)
+		}
+		return findList
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"github.com/Kong/go-pdk/entities"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseBodyValues(t *testing.T) {
+	jsonBody := `{"orderId": "orderA", "amount": 10.0, "rate": 1.5e2, "ratio": 0.25, "paid": true, "coupon": null,
+		"order": {"items": [{"sku": "sku-1", "count": 1}, {"sku": "sku-2", "count": 2}], "tags": ["a", "b"]},
+		"user.name": "nick", "big": 12345678901234567890}`
+	list := []struct {
+		contentType string
+		body        string
+		key         string
+		expected    []string
+	}{
+		{"application/json", jsonBody, "orderId", []string{"orderA"}},
+		{"application/json; charset=utf-8", jsonBody, "$.orderId", []string{"orderA"}},
+		//数字统一格式
+		{"application/json", jsonBody, "amount", []string{"10"}},
+		{"application/json", jsonBody, "rate", []string{"150"}},
+		{"application/json", jsonBody, "ratio", []string{"0.25"}},
+		{"application/json", jsonBody, "big", []string{"12345678901234567890"}},
+		{"application/json", jsonBody, "paid", []string{"true"}},
+		{"application/json", jsonBody, "coupon", nil},
+		{"application/json", jsonBody, "order.items[0].sku", []string{"sku-1"}},
+		{"application/json", jsonBody, "$.order.items[1].count", []string{"2"}},
+		{"application/json", jsonBody, "order.items[*].sku", []string{"sku-1", "sku-2"}},
+		{"application/json", jsonBody, "order.items[5].sku", nil},
+		{"application/json", jsonBody, "order.tags", []string{"a", "b"}},
+		{"application/json", jsonBody, "order", nil},
+		{"application/json", jsonBody, "$['user.name']", []string{"nick"}},
+		{"application/vnd.api+json", jsonBody, "orderId", []string{"orderA"}},
+		{"application/x-www-form-urlencoded", "orderId=orderA&orderId=orderB&name=a%20b", "orderId", []string{"orderA", "orderB"}},
+		{"application/x-www-form-urlencoded", "orderId=orderA&name=a%20b", "name", []string{"a b"}},
+		//格式错误的字段不影响其他字段
+		{"application/x-www-form-urlencoded", "orderId=orderA&bad=%zz", "orderId", []string{"orderA"}},
+		//前缀相同的key不会被匹配
+		{"", "myOrderId=orderA", "orderId", nil},
+		{"application/json", "", "orderId", nil},
+	}
+	for _, val := range list {
+		actual, err := getDefaultConf().parseBodyValues(val.contentType, val.body, val.key)
+		if err != nil {
+			t.Errorf("parseBodyValues [%s] failed, %s", val.key, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(actual, val.expected) {
+			t.Errorf("parseBodyValues [%s] return: [%v], expected: [%v]", val.key, actual, val.expected)
+		}
+	}
+}
+
+func TestGetBodyValuesWithoutContentType(t *testing.T) {
+	kong := newMockPdk(map[string]interface{}{
+		"kong.request.get_raw_body": "orderId=1",
+	})
+	actual, err := getDefaultConf().getBodyValues(kong, "orderId")
+	if err != nil || !reflect.DeepEqual(actual, []string{"1"}) {
+		t.Errorf("getBodyValues without Content-Type return: [%v %v], expected: [%v]", actual, err, []string{"1"})
+	}
+}
+
+func TestGetMultipartBodyValuesWithContentLength(t *testing.T) {
+	body := "--boundary\r\n" +
+		"Content-Disposition: form-data; name=\"orderId\"\r\n\r\n" +
+		"orderA\r\n" +
+		"--boundary--\r\n"
+	conf := getDefaultConf()
+	conf.MultipartMaxBytes = 100
+	list := []struct {
+		contentLength interface{}
+		expected      []string
+		err           error
+	}{
+		{strconv.Itoa(len(body)), []string{"orderA"}, nil},
+		//没有Content-Length时读取body
+		{errors.New("null response"), []string{"orderA"}, nil},
+		//超过限制时不读取body
+		{"101", nil, errMultipartTooLarge},
+	}
+	for _, val := range list {
+		contentLength := val.contentLength
+		kong, calls := newRecordingMockPdk(map[string]interface{}{
+			"kong.request.get_header": func(args []interface{}) interface{} {
+				if args[0] == "Content-Length" {
+					return contentLength
+				}
+				return "multipart/form-data; boundary=boundary"
+			},
+			"kong.request.get_raw_body": body,
+		})
+		actual, err := conf.getBodyValues(kong, "orderId")
+		if err != val.err || !reflect.DeepEqual(actual, val.expected) {
+			t.Errorf("getBodyValues with Content-Length [%v] return: [%v %v], expected: [%v %v]", val.contentLength, actual, err, val.expected, val.err)
+		}
+		for _, step := range calls() {
+			if val.expected == nil && step.Method == "kong.request.get_raw_body" {
+				t.Errorf("getBodyValues with Content-Length [%v] read body, expected not", val.contentLength)
+			}
+		}
+	}
+}
+
+func TestParseBodyValuesError(t *testing.T) {
+	list := []struct {
+		body string
+		key  string
+	}{
+		{`{"orderId": `, "orderId"},
+		{`{"orderId": "orderA"}`, "order..id"},
+		{`{"orderId": "orderA"}`, "order[x]"},
+		{`{"orderId": "orderA"}`, "order[0"},
+	}
+	for _, val := range list {
+		if _, err := getDefaultConf().parseBodyValues("application/json", val.body, val.key); err == nil {
+			t.Errorf("parseBodyValues [%s] [%s] success, expected error", val.body, val.key)
+		}
+	}
+}
+
+func TestParseMultipartBodyValues(t *testing.T) {
+	body := "--boundary\r\n" +
+		"Content-Disposition: form-data; name=\"orderId\"\r\n\r\n" +
+		"orderA\r\n" +
+		"--boundary\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"orderId.txt\"\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"orderId=orderB, some large file content\r\n" +
+		"--boundary\r\n" +
+		"Content-Disposition: form-data; name=\"orderId\"\r\n\r\n" +
+		"orderC\r\n" +
+		"--boundary--\r\n"
+	contentType := "multipart/form-data; boundary=boundary"
+	conf := getDefaultConf()
+	actual, err := conf.parseBodyValues(contentType, body, "orderId")
+	if err != nil || !reflect.DeepEqual(actual, []string{"orderA", "orderC"}) {
+		t.Errorf("parseBodyValues with multipart return: [%v %v], expected: [%v]", actual, err, []string{"orderA", "orderC"})
+	}
+	//文件字段不会被匹配
+	if actual, _ = conf.parseBodyValues(contentType, body, "file"); actual != nil {
+		t.Errorf("parseBodyValues with multipart file return: [%v], expected: [%v]", actual, nil)
+	}
+	//文件内容不计入限制
+	conf.MultipartMaxBytes = 12
+	if actual, err = conf.parseBodyValues(contentType, body, "orderId"); err != nil {
+		t.Errorf("parseBodyValues with MultipartMaxBytes 12 failed, %s", err.Error())
+	}
+	conf.MultipartMaxBytes = 11
+	if _, err = conf.parseBodyValues(contentType, body, "orderId"); err != errMultipartTooLarge {
+		t.Errorf("parseBodyValues with MultipartMaxBytes 11 return: [%v], expected: [%v]", err, errMultipartTooLarge)
+	}
+	if _, err = conf.parseBodyValues("multipart/form-data", body, "orderId"); err == nil {
+		t.Errorf("parseBodyValues with multipart without boundary success, expected error")
+	}
+}
+
+func TestAccessWithMultipartTooLarge(t *testing.T) {
+	body := "--boundary\r\n" +
+		"Content-Disposition: form-data; name=\"orderId\"\r\n\r\n" +
+		"orderA\r\n" +
+		"--boundary--\r\n"
+	list := []struct {
+		multipartTooLarge string
+		statuses          []int
+		remaining         []string
+	}{
+		//超过MultipartMaxBytes时body规则按匹配处理，添加大文件不能绕过限流
+		{"", []int{0, 0, 429}, []string{"1", "0", "0"}},
+		{multipartTooLargeMatch, []int{0, 0, 429}, []string{"1", "0", "0"}},
+		{multipartTooLargeDeny, []int{413, 413, 413}, []string{"", "", ""}},
+	}
+	for _, val := range list {
+		conf := getDefaultConf()
+		conf.Policy = policyLocal
+		conf.QPS = 0
+		conf.Minute = 2
+		conf.RedisLimitKeyPrefix = "multipart-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		conf.LimitResourcesJson = `[{"type": "body", "key": "orderId", "value": "orderA"}]`
+		conf.MultipartMaxBytes = 100
+		conf.MultipartTooLarge = val.multipartTooLarge
+		for i := range val.statuses {
+			kong, calls := newRecordingMockPdk(map[string]interface{}{
+				"kong.request.get_header": func(args []interface{}) interface{} {
+					if args[0] == "Content-Length" {
+						return "1000000"
+					}
+					return "multipart/form-data; boundary=boundary"
+				},
+				"kong.request.get_raw_body": body,
+				"kong.client.get_consumer":  entities.Consumer{},
+				"kong.router.get_service":   entities.Service{},
+				"kong.router.get_route":     entities.Route{},
+				"kong.response.set_header":  nil,
+			})
+			conf.Access(kong)
+			status, remaining := 0, ""
+			for _, step := range calls() {
+				if step.Method == "kong.response.exit" {
+					status = step.Args[0].(int)
+				}
+				if step.Method == "kong.response.set_header" && step.Args[0] == "X-Rate-Limiting-Remaining" {
+					remaining = step.Args[1].(string)
+				}
+			}
+			if status != val.statuses[i] || remaining != val.remaining[i] {
+				t.Errorf("Access with MultipartTooLarge [%s] request %d return: [%d %s], expected: [%d %s]", val.multipartTooLarge, i, status, remaining, val.statuses[i], val.remaining[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//redis出错时的处理方式:拒绝
+const onStoreErrorDeny = "deny"
+
+//redis出错时的处理方式:使用本地内存限流
+const onStoreErrorLocal = "local"
+
+//redis出错时拒绝请求默认返回的状态码
+const defaultStoreErrorStatus = 503
+
+//熔断后默认跳过redis的时间
+const defaultCircuitBreakerCooldown = 5 * time.Second
+
+//默认连续失败多少次后熔断
+const defaultCircuitBreakerFailureThreshold = 5
+
+//半开状态下默认允许同时访问redis的探测请求数
+const defaultCircuitBreakerHalfOpenRequests = 1
+
+//熔断器状态:关闭，正常访问redis
+const circuitClosed = "closed"
+
+//熔断器状态:打开，不访问redis
+const circuitOpen = "open"
+
+//熔断器状态:半开，只允许探测请求访问redis
+const circuitHalfOpen = "half-open"
+
+//熔断器状态写入kong.ctx.shared的key
+const circuitBreakerSharedKey = "rate_limiting_circuit_breaker"
+
+//熔断期间不访问redis，直接返回该错误
+var errCircuitOpen = errors.New("redis circuit breaker is open")
+
+//redis熔断器，key为redis连接相关的配置
+var circuitBreakers = newBoundedCache(configCacheSize)
+
+//redis熔断器，redis连续连接失败或超时后在冷却时间内不再访问redis，避免每个请求都等待超时，冷却时间结束后通过探测请求判断是否恢复
+type circuitBreaker struct {
+	sync.Mutex
+	name      string    //redis地址，用于日志
+	state     string    //当前状态，为空时为closed
+	failures  int       //连续失败次数
+	openUntil time.Time //熔断结束时间
+	probes    int       //半开状态下正在访问redis的探测请求数
+	opened    int64     //累计熔断次数
+	rejected  int64     //累计因熔断未访问redis的请求数
+	unhealthy int32     //有连续失败或没有关闭时为1，不加锁判断是否需要输出状态
+}
+
+//获取当前redis连接配置对应的熔断器
+func (conf Config) getCircuitBreaker() *circuitBreaker {
+	key := conf.getRedisClientKey()
+	if breaker, ok := circuitBreakers.Load(key); ok {
+		return breaker.(*circuitBreaker)
+	}
+	name := net.JoinHostPort(conf.RedisHost, strconv.Itoa(conf.RedisPort))
+	breaker, _ := circuitBreakers.LoadOrStore(key, &circuitBreaker{name: name})
+	return breaker.(*circuitBreaker)
+}
+
+//获取熔断后跳过redis的时间
+func (conf Config) getCircuitBreakerCooldown() time.Duration {
+	if conf.CircuitBreakerCooldownSecond > 0 {
+		return time.Duration(conf.CircuitBreakerCooldownSecond) * time.Second
+	}
+	return defaultCircuitBreakerCooldown
+}
+
+//获取熔断的连续失败次数
+func (conf Config) getCircuitBreakerFailureThreshold() int {
+	if conf.CircuitBreakerFailureThreshold > 0 {
+		return conf.CircuitBreakerFailureThreshold
+	}
+	return defaultCircuitBreakerFailureThreshold
+}
+
+//获取半开状态下的探测请求数
+func (conf Config) getCircuitBreakerHalfOpenRequests() int {
+	if conf.CircuitBreakerHalfOpenRequests > 0 {
+		return conf.CircuitBreakerHalfOpenRequests
+	}
+	return defaultCircuitBreakerHalfOpenRequests
+}
+
+//获取redis出错时拒绝请求返回的状态码
+func (conf Config) getStoreErrorStatus() int {
+	if conf.OnStoreErrorStatus > 0 {
+		return conf.OnStoreErrorStatus
+	}
+	return defaultStoreErrorStatus
+}
+
+//通过熔断器执行lua脚本
+func (conf Config) evalRedis(script string, keys []string, args []interface{}) (interface{}, error) {
+	breaker := conf.getCircuitBreaker()
+	allowed, probe := breaker.allow(time.Now(), conf.getCircuitBreakerHalfOpenRequests())
+	if !allowed {
+		return nil, errCircuitOpen
+	}
+	reply, err := conf.getRedisClient().Eval(ctx, script, keys, args...).Result()
+	breaker.record(err, probe, time.Now(), conf.getCircuitBreakerFailureThreshold(), conf.getCircuitBreakerCooldown())
+	return reply, err
+}
+
+//通过熔断器使用pipeline执行多个命令，一次往返发送所有命令，熔断时返回nil
+func (conf Config) pipelineRedis(fn func(pipe redis.Pipeliner)) ([]redis.Cmder, error) {
+	breaker := conf.getCircuitBreaker()
+	allowed, probe := breaker.allow(time.Now(), conf.getCircuitBreakerHalfOpenRequests())
+	if !allowed {
+		return nil, errCircuitOpen
+	}
+	cmds, err := conf.getRedisClient().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		fn(pipe)
+		return nil
+	})
+	breaker.record(err, probe, time.Now(), conf.getCircuitBreakerFailureThreshold(), conf.getCircuitBreakerCooldown())
+	return cmds, err
+}
+
+//是否允许访问redis，熔断时间结束后进入半开状态，只允许halfOpenRequests个探测请求同时访问redis，probe表示是否为探测请求
+func (breaker *circuitBreaker) allow(now time.Time, halfOpenRequests int) (allowed bool, probe bool) {
+	breaker.Lock()
+	defer breaker.Unlock()
+	if breaker.state == circuitOpen {
+		if now.Before(breaker.openUntil) {
+			breaker.rejected++
+			return false, false
+		}
+		breaker.setState(circuitHalfOpen)
+		breaker.probes = 0
+	}
+	if breaker.state == circuitHalfOpen {
+		if breaker.probes >= halfOpenRequests {
+			breaker.rejected++
+			return false, false
+		}
+		breaker.probes++
+		return true, true
+	}
+	return true, false
+}
+
+//记录访问redis的结果，连续连接失败或超时达到threshold次时熔断，半开状态下由探测请求的结果决定恢复或继续熔断，
+//redis返回的错误(如脚本错误)说明redis可用，按成功处理
+func (breaker *circuitBreaker) record(err error, probe bool, now time.Time, threshold int, cooldown time.Duration) {
+	breaker.Lock()
+	defer breaker.Unlock()
+	defer breaker.refreshUnhealthy()
+	if probe && breaker.probes > 0 {
+		breaker.probes--
+	}
+	if isRedisAvailable(err) {
+		breaker.failures = 0
+		if probe && breaker.state == circuitHalfOpen {
+			breaker.setState(circuitClosed)
+		}
+		return
+	}
+	breaker.failures++
+	//熔断前已开始的请求不影响熔断及半开状态
+	if breaker.state == circuitOpen || (breaker.state == circuitHalfOpen && !probe) {
+		return
+	}
+	if breaker.state == circuitHalfOpen || breaker.failures >= threshold {
+		breaker.openUntil = now.Add(cooldown)
+		breaker.opened++
+		log.Printf("[circuitBreaker] redis %s failed %d times, last err: %v", breaker.name, breaker.failures, err)
+		breaker.setState(circuitOpen)
+	}
+}
+
+//切换状态并记录日志，调用方需持有锁
+func (breaker *circuitBreaker) setState(state string) {
+	from := breaker.getState()
+	breaker.state = state
+	breaker.refreshUnhealthy()
+	log.Printf("[circuitBreaker] redis %s circuit breaker state changed from %s to %s", breaker.name, from, state)
+}
+
+//更新是否有连续失败或没有关闭，调用方需持有锁
+func (breaker *circuitBreaker) refreshUnhealthy() {
+	var unhealthy int32
+	if breaker.failures > 0 || breaker.getState() != circuitClosed {
+		unhealthy = 1
+	}
+	atomic.StoreInt32(&breaker.unhealthy, unhealthy)
+}
+
+//是否有连续失败或没有关闭
+func (breaker *circuitBreaker) isUnhealthy() bool {
+	return atomic.LoadInt32(&breaker.unhealthy) == 1
+}
+
+//获取当前状态，调用方需持有锁
+func (breaker *circuitBreaker) getState() string {
+	if breaker.state == "" {
+		return circuitClosed
+	}
+	return breaker.state
+}
+
+//熔断器状态及统计，用于日志及监控
+func (breaker *circuitBreaker) stats() map[string]interface{} {
+	breaker.Lock()
+	defer breaker.Unlock()
+	return map[string]interface{}{
+		"redis":    breaker.name,
+		"state":    breaker.getState(),
+		"failures": breaker.failures,
+		"opened":   breaker.opened,
+		"rejected": breaker.rejected,
+	}
+}
+
+//访问redis的结果是否说明redis可用，连接失败或超时时不可用
+func isRedisAvailable(err error) bool {
+	if err == nil || err == redis.Nil {
+		return true
+	}
+	_, ok := err.(redis.Error)
+	return ok
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"github.com/Kong/go-pdk"
+	"github.com/Kong/go-pdk/entities"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//redis返回的错误，如脚本错误
+type testRedisError string
+
+func (err testRedisError) Error() string {
+	return string(err)
+}
+
+func (testRedisError) RedisError() {}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := &circuitBreaker{}
+	now := time.Now()
+	connErr := errors.New("dial tcp 127.0.0.1:1: connect: connection refused")
+	//依次执行record(record不为nil时)或allow，连续失败2次熔断，熔断1秒，半开状态允许1个探测请求
+	list := []struct {
+		record  error
+		probe   bool
+		offset  time.Duration
+		state   string
+		allowed bool
+	}{
+		{connErr, false, 0, circuitClosed, false},
+		//redis返回的错误说明redis可用，重置连续失败次数
+		{testRedisError("ERR unknown command"), false, 0, circuitClosed, false},
+		{connErr, false, 0, circuitClosed, false},
+		{nil, false, 0, circuitClosed, true},
+		{connErr, false, 0, circuitOpen, false},
+		{nil, false, 999 * time.Millisecond, circuitOpen, false},
+		//熔断结束后只允许一个探测请求
+		{nil, true, time.Second, circuitHalfOpen, true},
+		{nil, false, time.Second, circuitHalfOpen, false},
+		//熔断前开始的请求结束时不改变状态，也不释放探测名额
+		{redis.Nil, false, time.Second, circuitHalfOpen, false},
+		{connErr, false, time.Second, circuitHalfOpen, false},
+		{nil, false, time.Second, circuitHalfOpen, false},
+		//探测失败重新熔断
+		{connErr, true, time.Second, circuitOpen, false},
+		{nil, true, 2 * time.Second, circuitHalfOpen, true},
+		//探测成功恢复
+		{redis.Nil, true, 2 * time.Second, circuitClosed, false},
+		{nil, false, 2 * time.Second, circuitClosed, true},
+	}
+	for i, val := range list {
+		allowed, probe := false, val.probe
+		if val.record != nil {
+			breaker.record(val.record, val.probe, now.Add(val.offset), 2, time.Second)
+		} else {
+			allowed, probe = breaker.allow(now.Add(val.offset), 1)
+		}
+		if state := breaker.stats()["state"]; state != val.state || allowed != val.allowed || probe != val.probe {
+			t.Errorf("circuit breaker at step %d return: [%v %v %v], expected: [%v %v %v]", i, state, allowed, probe, val.state, val.allowed, val.probe)
+		}
+	}
+	if stats := breaker.stats(); stats["opened"] != int64(2) || stats["rejected"] != int64(3) {
+		t.Errorf("circuit breaker stats return: [%v], expected opened: [2], rejected: [3]", stats)
+	}
+}
+
+//不可用的redis配置
+func getUnavailableRedisConf() *Config {
+	conf := getDefaultConf()
+	conf.RedisHost = "127.0.0.1"
+	conf.RedisPort = 1
+	conf.LimitResourcesJson = ""
+	conf.RedisLimitKeyPrefix = "unavailable-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	return conf
+}
+
+func TestGetRemainingAndIncrWithCircuitBreaker(t *testing.T) {
+	kong := &pdk.PDK{}
+	conf := getUnavailableRedisConf()
+	conf.CircuitBreakerFailureThreshold = 1
+	if _, err := conf.getRemainingAndIncr(kong, "breaker", time.Now()); err == nil || err == errCircuitOpen {
+		t.Errorf("getRemainingAndIncr with unavailable redis return: [%v], expected connection error", err)
+	}
+	//熔断期间不再访问redis
+	if _, err := conf.getRemainingAndIncr(kong, "breaker", time.Now()); err != errCircuitOpen {
+		t.Errorf("getRemainingAndIncr with open circuit breaker return: [%v], expected: [%v]", err, errCircuitOpen)
+	}
+}
+
+func TestAccessOnStoreError(t *testing.T) {
+	replies := map[string]interface{}{
+		"kong.client.get_consumer":  entities.Consumer{},
+		"kong.router.get_service":   entities.Service{},
+		"kong.router.get_route":     entities.Route{},
+		"kong.response.set_header":  nil,
+		"kong.log.err":              nil,
+		"kong.ctx.shared.set":       nil,
+		"kong.request.get_path":     "/orders",
+		"kong.request.get_header":   "",
+		"kong.client.get_forwarded": "",
+	}
+	list := []struct {
+		available    bool
+		onStoreError string
+		status       int
+		remaining    string
+	}{
+		{false, "", 0, ""},
+		{false, onStoreErrorDeny, 503, ""},
+		{false, onStoreErrorLocal, 0, "2"},
+		//redis正常时熔断器关闭，不写入kong.ctx.shared
+		{true, onStoreErrorDeny, 0, "2"},
+	}
+	for _, val := range list {
+		conf := getUnavailableRedisConf()
+		if val.available {
+			defaultConf := getDefaultConf()
+			conf.RedisHost, conf.RedisPort = defaultConf.RedisHost, defaultConf.RedisPort
+		}
+		conf.QPS = 3
+		conf.OnStoreError = val.onStoreError
+		conf.CircuitBreakerFailureThreshold = 1
+		kong, calls := newRecordingMockPdk(replies)
+		conf.Access(kong)
+		status, remaining, shared := 0, "", false
+		for _, step := range calls() {
+			if step.Method == "kong.ctx.shared.set" && step.Args[0] == circuitBreakerSharedKey {
+				shared = true
+			}
+			if step.Method == "kong.response.exit" {
+				status = step.Args[0].(int)
+			}
+			if step.Method == "kong.response.set_header" && step.Args[0] == "X-Rate-Limiting-Remaining" {
+				remaining = step.Args[1].(string)
+			}
+		}
+		if shared == val.available {
+			t.Errorf("Access with OnStoreError [%s] set %s return: [%v], expected: [%v]", val.onStoreError, circuitBreakerSharedKey, shared, !val.available)
+		}
+		if status != val.status || remaining != val.remaining {
+			t.Errorf("Access with OnStoreError [%s] return: [%d %s], expected: [%d %s]", val.onStoreError, status, remaining, val.status, val.remaining)
+		}
+	}
+}
+
+func TestAccessPublishCircuitBreakerStats(t *testing.T) {
+	replies := map[string]interface{}{
+		"kong.client.get_consumer": entities.Consumer{},
+		"kong.router.get_service":  entities.Service{},
+		"kong.router.get_route":    entities.Route{},
+		"kong.response.set_header": nil,
+		"kong.log.err":             nil,
+		"kong.ctx.shared.set":      nil,
+	}
+	conf := getUnavailableRedisConf()
+	//使用单独的熔断器
+	conf.RedisDB = 14
+	conf.Policy = policyHybrid
+	//是否写入kong.ctx.shared
+	getShared := func() map[string]interface{} {
+		kong, calls := newRecordingMockPdk(replies)
+		conf.Access(kong)
+		for _, step := range calls() {
+			if step.Method == "kong.ctx.shared.set" && step.Args[0] == circuitBreakerSharedKey {
+				return step.Args[1].(map[string]interface{})
+			}
+		}
+		return nil
+	}
+	if stats := getShared(); stats != nil {
+		t.Errorf("Access without redis failure set %s: [%v], expected not", circuitBreakerSharedKey, stats)
+	}
+	//hybrid策略在后台同步失败，熔断器未打开时也输出连续失败次数
+	if _, err := conf.evalRedis(hybridSyncScript, nil, nil); err == nil {
+		t.Fatalf("evalRedis with unavailable redis success, expected error")
+	}
+	if stats := getShared(); stats == nil || stats["state"] != circuitClosed || stats["failures"] != 1 {
+		t.Errorf("Access with redis failure set %s: [%v], expected state: [%s], failures: [%d]", circuitBreakerSharedKey, stats, circuitClosed, 1)
+	}
+}
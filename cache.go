@@ -0,0 +1,85 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+//按配置缓存的最大条目数，远大于网关中不同插件配置的数量，避免配置多时反复解析和编译正则，配置修改后旧配置的条目会被逐渐淘汰，避免插件进程运行期间无限增长
+const configCacheSize = 10000
+
+//有容量限制的缓存，超出容量时淘汰最久未使用的条目，方法与sync.Map相同
+type boundedCache struct {
+	sync.Mutex
+	capacity int
+	items    map[interface{}]*list.Element
+	order    *list.List //最近使用的在前
+}
+
+//缓存条目
+type boundedCacheItem struct {
+	key   interface{}
+	value interface{}
+}
+
+//创建有容量限制的缓存
+func newBoundedCache(capacity int) *boundedCache {
+	return &boundedCache{
+		capacity: capacity,
+		items:    map[interface{}]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+//获取缓存的值
+func (cache *boundedCache) Load(key interface{}) (value interface{}, ok bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	element, ok := cache.items[key]
+	if !ok {
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	return element.Value.(*boundedCacheItem).value, true
+}
+
+//保存缓存的值
+func (cache *boundedCache) Store(key interface{}, value interface{}) {
+	cache.Lock()
+	defer cache.Unlock()
+	if element, ok := cache.items[key]; ok {
+		element.Value.(*boundedCacheItem).value = value
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.add(key, value)
+}
+
+//key存在时返回已有的值，否则保存并返回value
+func (cache *boundedCache) LoadOrStore(key interface{}, value interface{}) (actual interface{}, loaded bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	if element, ok := cache.items[key]; ok {
+		cache.order.MoveToFront(element)
+		return element.Value.(*boundedCacheItem).value, true
+	}
+	cache.add(key, value)
+	return value, false
+}
+
+//添加新条目，超出容量时淘汰最久未使用的条目，调用方需持有锁
+func (cache *boundedCache) add(key interface{}, value interface{}) {
+	cache.items[key] = cache.order.PushFront(&boundedCacheItem{key: key, value: value})
+	for cache.order.Len() > cache.capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.items, oldest.Value.(*boundedCacheItem).key)
+	}
+}
+
+//缓存的条目数
+func (cache *boundedCache) Len() int {
+	cache.Lock()
+	defer cache.Unlock()
+	return cache.order.Len()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestBoundedCache(t *testing.T) {
+	cache := newBoundedCache(2)
+	cache.Store("a", 1)
+	cache.Store("b", 2)
+	//访问a后b成为最久未使用的条目
+	if value, ok := cache.Load("a"); !ok || value != 1 {
+		t.Errorf("Load [a] return: [%v %v], expected: [%v %v]", value, ok, 1, true)
+	}
+	if actual, loaded := cache.LoadOrStore("c", 3); loaded || actual != 3 {
+		t.Errorf("LoadOrStore [c] return: [%v %v], expected: [%v %v]", actual, loaded, 3, false)
+	}
+	if _, ok := cache.Load("b"); ok {
+		t.Errorf("Load [b] after eviction return: [%v], expected: [%v]", ok, false)
+	}
+	if actual, loaded := cache.LoadOrStore("a", 4); !loaded || actual != 1 {
+		t.Errorf("LoadOrStore [a] return: [%v %v], expected: [%v %v]", actual, loaded, 1, true)
+	}
+}
+
+func TestLimitResourceCacheSize(t *testing.T) {
+	conf := getDefaultConf()
+	//网关中有大量不同的规则配置时，已解析的配置仍在缓存中，不会反复解析和编译正则
+	count := 1000
+	jsonOf := func(i int) string {
+		return `[{"type": "path", "key": "path", "value": "^/tenant-` + strconv.Itoa(i) + `/([^/]+)", "match": "regex"}]`
+	}
+	for i := 0; i < count; i++ {
+		conf.LimitResourcesJson = jsonOf(i)
+		if _, err := conf.getLimitResources(); err != nil {
+			t.Fatalf("getLimitResources failed, %s", err.Error())
+		}
+	}
+	for i := 0; i < count; i++ {
+		conf.LimitResourcesJson = jsonOf(i)
+		cacheKey := conf.Algorithm + "\n" + conf.Path + "\n" + conf.LimitResourcesJson
+		if _, ok := limitResourceCache.Load(cacheKey); !ok {
+			t.Fatalf("limitResourceCache evicted config %d of %d, expected cached", i, count)
+		}
+	}
+	if configCacheSize < count {
+		t.Errorf("configCacheSize return: [%d], expected: [>= %d]", configCacheSize, count)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/Kong/go-pdk"
+	"strings"
+)
+
+//获取当前请求的consumer，key为id、username或custom_id，其他key同时返回id和username
+func getConsumerValues(kong *pdk.PDK, key string) ([]string, error) {
+	consumer, err := kong.Client.GetConsumer()
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(key) {
+	case "id":
+		return []string{consumer.Id}, nil
+	case "username":
+		return []string{consumer.Username}, nil
+	case "custom_id":
+		return []string{consumer.CustomId}, nil
+	default:
+		return []string{consumer.Id, consumer.Username}, nil
+	}
+}
+
+//获取当前请求认证使用的credential id，key为consumer_id时返回credential所属的consumer id
+func getCredentialValues(kong *pdk.PDK, key string) ([]string, error) {
+	credential, err := kong.Client.GetCredential()
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(key) == "consumer_id" {
+		return []string{credential.ConsumerId}, nil
+	}
+	return []string{credential.Id}, nil
+}
+
+//获取认证插件(如ldap-auth)写入kong.ctx.shared的authenticated_groups，可能是数组或英文逗号分隔的字符串
+func getAuthenticatedGroups(kong *pdk.PDK) ([]string, error) {
+	reply, err := kong.Ctx.GetSharedAny("authenticated_groups")
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	switch value := reply.(type) {
+	case string:
+		groups = strings.Split(value, ",")
+	case []string:
+		groups = value
+	case []interface{}:
+		for _, item := range value {
+			if group, ok := item.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	}
+	var findList []string
+	for _, group := range groups {
+		if group = strings.TrimSpace(group); group != "" {
+			findList = append(findList, group)
+		}
+	}
+	return findList, nil
+}
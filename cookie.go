@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/Kong/go-pdk"
+	"strings"
+)
+
+//获取请求中指定名称的cookie值，同名cookie可能有多个
+func getCookieValues(kong *pdk.PDK, name string) ([]string, error) {
+	headers, err := kong.Request.GetHeaders(-1)
+	if err != nil {
+		return nil, err
+	}
+	var findList []string
+	//http2下cookie可能被拆分为多个header
+	for _, header := range headers["cookie"] {
+		findList = append(findList, parseCookie(header, name)...)
+	}
+	return findList, nil
+}
+
+//解析Cookie header，格式为name1=value1; name2=value2，值可以用双引号包裹
+func parseCookie(header string, name string) []string {
+	var findList []string
+	for _, pair := range strings.Split(header, ";") {
+		pair = strings.TrimSpace(pair)
+		index := strings.Index(pair, "=")
+		if index <= 0 || strings.TrimSpace(pair[:index]) != name {
+			continue
+		}
+		value := strings.TrimSpace(pair[index+1:])
+		if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		findList = append(findList, value)
+	}
+	return findList
+}
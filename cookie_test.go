@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCookie(t *testing.T) {
+	list := []struct {
+		header   string
+		name     string
+		expected []string
+	}{
+		{"session=abc", "session", []string{"abc"}},
+		{"lang=zh; session=abc; theme=dark", "session", []string{"abc"}},
+		{"  lang=zh ;session = abc  ", "session", []string{"abc"}},
+		{`session="a b c"; lang=zh`, "session", []string{"a b c"}},
+		{"session=abc; session=def", "session", []string{"abc", "def"}},
+		{"mysession=abc; session2=def", "session", nil},
+		{"session=; lang=zh", "session", []string{""}},
+		{"invalid; =abc", "session", nil},
+		{"", "session", nil},
+	}
+	for _, val := range list {
+		actual := parseCookie(val.header, val.name)
+		if !reflect.DeepEqual(actual, val.expected) {
+			t.Errorf("parseCookie [%s] return: [%v], expected: [%v]", val.header, actual, val.expected)
+		}
+	}
+}
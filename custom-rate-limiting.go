@@ -9,19 +9,22 @@ import (
 	"github.com/go-redis/redis/v8"
 	"gopkg.in/go-playground/validator.v9"
 	"log"
+	"math"
+	"net"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
 //1.build
-//go build -buildmode plugin  custom-rate-limiting.go
+//go build -buildmode plugin -o custom-rate-limiting.so .
 //2.将生成的.so文件放到go_plugins_dir定义的目录中
 //cp -f custom-rate-limiting.so dir_to/plugins/
 //3.不停止kong更新插件
 //kong prepare && kong reload
 //开发环境调试一句话命令
-//go build -buildmode plugin  custom-rate-limiting.go && cp -f custom-rate-limiting.so ../plugins/ && kong prepare && kong reload
+//go build -buildmode plugin -o custom-rate-limiting.so . && cp -f custom-rate-limiting.so ../plugins/ && kong prepare && kong reload
 
 /*
 json格式
@@ -47,20 +50,26 @@ const matchConditionOr = "or"
 //匹配条件:and
 const matchConditionAnd = "and"
 
+//Redis部署模式:集群
+const redisModeCluster = "cluster"
+
+//Redis部署模式:哨兵
+const redisModeSentinel = "sentinel"
+
 //版本号
 const version = "v0.1.1"
 
 var ctx = context.Background()
 
-//限流资源列表
-var limitResourceList []limitResource
+//解析后的限流资源列表缓存，key为影响解析结果的配置，只在配置变化时重新解析和编译匹配模式
+var limitResourceCache = newBoundedCache(configCacheSize)
 
 //kong 插件配置
 type Config struct {
-	QPS                 int    `json:"QPS" validate:"required,gte=0"` //请求限制的QPS值
-	Log                 bool   `json:"Log" validate:"omitempty"`      //是否记录日志
-	Path                string `json:"Path"`                          //资源路径
-	LimitResourcesJson  string `json:"LimitResourcesJson"`            //流控规则选项，使用json配置，然后解析
+	QPS                 int    `json:"QPS" validate:"required_without_all=Second Minute Hour Day Month,gte=0"` //请求限制的QPS值，与Second、Minute、Hour、Day、Month至少配置一个
+	Log                 bool   `json:"Log" validate:"omitempty"`                                               //是否记录日志
+	Path                string `json:"Path"`                                                                   //资源路径
+	LimitResourcesJson  string `json:"LimitResourcesJson"`                                                     //流控规则选项，使用json配置，然后解析
 	RedisHost           string `json:"RedisHost" validate:"required"`
 	RedisPort           int    `json:"RedisPort" validate:"required,gte=1,lte=65535"`
 	RedisAuth           string `json:"RedisAuth" validate:"omitempty"`
@@ -69,13 +78,85 @@ type Config struct {
 	RedisLimitKeyPrefix string `json:"RedisLimitKeyPrefix" validate:"omitempty"`         //Redis限流key前缀
 	HideClientHeader    bool   `json:"HideClientHeader" validate:"omitempty"`            //隐藏response header
 	MatchCondition      string `json:"MatchCondition" validate:"omitempty,oneof=and or"` //流控规则匹配条件，and：所有规则都需要匹配到则成功，or: 匹配到一个则成功, 为空时默认为and
+	TrustedProxies      string `json:"TrustedProxies" validate:"omitempty"`              //可信代理的ip或网段，使用英文逗号分隔，配置后只信任来自这些代理的X-Forwarded-For，为空时使用kong的trusted_ips配置
+
+	Algorithm            string `json:"Algorithm" validate:"omitempty,oneof=fixed-window sliding-window-counter sliding-window-log token-bucket gcra"` //限流算法，fixed-window：固定窗口，sliding-window-counter：滑动窗口计数，sliding-window-log：滑动窗口日志，token-bucket：令牌桶，gcra：通用信元速率算法，为空时默认为fixed-window
+	Rate                 int    `json:"Rate" validate:"omitempty,gte=0"`                                                                               //令牌桶(gcra)每个补充周期补充的令牌数，为空时默认为每秒请求限制
+	Burst                int    `json:"Burst" validate:"omitempty,gte=0"`                                                                              //令牌桶(gcra)容量，即允许的突发请求数，为空时默认为Rate
+	RefillIntervalSecond int    `json:"RefillIntervalSecond" validate:"omitempty,gte=0"`                                                               //令牌桶(gcra)补充周期(秒)，为空时默认为1秒
+
+	Second int `json:"Second" validate:"omitempty,gte=0"` //每秒请求限制，为空时使用QPS
+	Minute int `json:"Minute" validate:"omitempty,gte=0"` //每分钟请求限制
+	Hour   int `json:"Hour" validate:"omitempty,gte=0"`   //每小时请求限制
+	Day    int `json:"Day" validate:"omitempty,gte=0"`    //每天请求限制
+	Month  int `json:"Month" validate:"omitempty,gte=0"`  //每月请求限制(自然月)
+
+	MultipartMaxBytes int    `json:"MultipartMaxBytes" validate:"omitempty,gte=0"`            //multipart/form-data body的最大字节数，Content-Length超过时不读取body，没有Content-Length时限制非文件字段的字节数，超过时按MultipartTooLarge处理，为空时默认为1MB
+	MultipartTooLarge string `json:"MultipartTooLarge" validate:"omitempty,oneof=match deny"` //multipart body超过MultipartMaxBytes时的处理，match：body规则按匹配处理，使用固定的限流key(multipart-too-large)，按规则的限制(values中*的限制)限流(默认)，deny：拒绝请求，返回413
+
+	JwtSecret     string `json:"JwtSecret" validate:"omitempty"`     //jwt_claim规则校验HS256/HS384/HS512签名的密钥，与JwtPublicKeys都为空时只解码不校验
+	JwtPublicKeys string `json:"JwtPublicKeys" validate:"omitempty"` //jwt_claim规则校验RS*/ES*签名的PEM格式公钥，可配置多个
+
+	BypassIps            string `json:"BypassIps" validate:"omitempty"`            //免限流的ip或网段，使用英文逗号分隔
+	BypassConsumers      string `json:"BypassConsumers" validate:"omitempty"`      //免限流的consumer id或username，使用英文逗号分隔
+	BypassHeaders        string `json:"BypassHeaders" validate:"omitempty"`        //免限流的header，格式为name:value，使用英文逗号分隔，value为空时有该header即免限流
+	ExcludeResourcesJson string `json:"ExcludeResourcesJson" validate:"omitempty"` //免限流规则，格式与LimitResourcesJson相同，匹配到任意一个规则即免限流
+
+	RedisMode         string `json:"RedisMode" validate:"omitempty,oneof=standalone cluster sentinel"` //Redis部署模式，standalone：单节点(默认)，cluster：集群，sentinel：哨兵，集群模式下RedisHost:RedisPort作为第一个种子节点，哨兵模式下作为第一个哨兵节点
+	RedisClusterNodes string `json:"RedisClusterNodes" validate:"omitempty"`                           //集群模式下的其他种子节点，格式为host:port，使用英文逗号分隔
+
+	RedisSentinelMaster   string `json:"RedisSentinelMaster" validate:"omitempty"`   //哨兵模式下的master名称
+	RedisSentinelNodes    string `json:"RedisSentinelNodes" validate:"omitempty"`    //哨兵模式下的其他哨兵节点，格式为host:port，使用英文逗号分隔
+	RedisSentinelPassword string `json:"RedisSentinelPassword" validate:"omitempty"` //哨兵节点的密码，RedisAuth为master的密码
+
+	RedisPoolSize          int `json:"RedisPoolSize" validate:"omitempty,gte=0"`          //每个redis节点的最大连接数，为空时默认为每个CPU 10个连接
+	RedisMinIdleConns      int `json:"RedisMinIdleConns" validate:"omitempty,gte=0"`      //每个redis节点保持的最小空闲连接数
+	RedisIdleTimeoutSecond int `json:"RedisIdleTimeoutSecond" validate:"omitempty,gte=0"` //空闲连接的关闭时间(秒)，为空时默认为5分钟
+
+	RedisUsername              string `json:"RedisUsername" validate:"omitempty"`              //Redis 6 ACL用户名，RedisAuth为该用户的密码
+	RedisTLS                   bool   `json:"RedisTLS" validate:"omitempty"`                   //是否使用TLS连接redis
+	RedisTLSCaFile             string `json:"RedisTLSCaFile" validate:"omitempty"`             //校验服务端证书的CA证书文件(PEM)，为空时使用系统CA
+	RedisTLSCertFile           string `json:"RedisTLSCertFile" validate:"omitempty"`           //客户端证书文件(PEM)，需要与RedisTLSKeyFile同时配置
+	RedisTLSKeyFile            string `json:"RedisTLSKeyFile" validate:"omitempty"`            //客户端私钥文件(PEM)
+	RedisTLSServerName         string `json:"RedisTLSServerName" validate:"omitempty"`         //校验服务端证书使用的域名，为空时使用连接的host
+	RedisTLSInsecureSkipVerify bool   `json:"RedisTLSInsecureSkipVerify" validate:"omitempty"` //不校验服务端证书，仅用于测试环境
+
+	Policy                  string `json:"Policy" validate:"omitempty,oneof=redis local hybrid"` //限流策略，redis：使用redis计数，所有节点共享(默认)，local：计数保存在插件进程内存中，不依赖redis，多个kong节点各自计数，hybrid：本地计数并定期同步到redis，只支持fixed-window算法
+	SyncIntervalMillisecond int    `json:"SyncIntervalMillisecond" validate:"omitempty,gte=0"`   //hybrid策略同步到redis的间隔(毫秒)，为空时默认为1000毫秒
+	MaxDrift                int    `json:"MaxDrift" validate:"omitempty,gte=0"`                  //hybrid策略每个key未同步的最大计数，达到后立即在后台同步，为空时只按间隔同步
+
+	OnStoreError                   string `json:"OnStoreError" validate:"omitempty,oneof=allow deny local"`  //redis出错或熔断时的处理方式，allow：放行(默认)，deny：拒绝，local：使用本地内存限流
+	OnStoreErrorStatus             int    `json:"OnStoreErrorStatus" validate:"omitempty,gte=400,lte=599"`   //OnStoreError为deny时返回的状态码，为空时默认为503
+	CircuitBreakerCooldownSecond   int    `json:"CircuitBreakerCooldownSecond" validate:"omitempty,gte=0"`   //redis连接失败或超时后熔断的时间(秒)，期间不访问redis，直接按OnStoreError处理，为空时默认为5秒
+	CircuitBreakerFailureThreshold int    `json:"CircuitBreakerFailureThreshold" validate:"omitempty,gte=0"` //redis连续失败多少次后熔断，为空时默认为5次
+	CircuitBreakerHalfOpenRequests int    `json:"CircuitBreakerHalfOpenRequests" validate:"omitempty,gte=0"` //熔断时间结束后(半开状态)允许同时访问redis的探测请求数，探测成功则恢复，失败则继续熔断，为空时默认为1
 }
 
 //限流资源
 type limitResource struct {
-	Type  string `json:"type"`  //限流类型，使用英文逗号分隔,如：header,query,body
-	Key   string `json:"key"`   //限流key
-	Value string `json:"value"` //限流值，使用英文逗号分隔，如：value1,value2,orderId1
+	Type   string         `json:"type"`   //限流类型，使用英文逗号分隔,如：header,query,body
+	Key    string         `json:"key"`    //限流key
+	Value  string         `json:"value"`  //限流值，使用英文逗号分隔，如：value1,value2,orderId1，为空或*时匹配任意值并按实际的值分别限流，regex和glob不分隔，多个模式使用values配置
+	Values map[string]int `json:"values"` //按值配置的QPS限制，如：{"orderA": 5, "orderB": 50, "*": 10}，*表示其他任意值，0表示使用规则的限制
+	Match  string         `json:"match"`  //匹配方式，exact：完全相等(默认)，prefix：前缀，suffix：后缀，regex：正则，glob：通配符
+
+	All []limitResource `json:"all"` //规则组，所有子规则都匹配时匹配，使用所有子规则的值作为限流key
+	Any []limitResource `json:"any"` //规则组，任意一个子规则匹配时匹配，使用第一个匹配的子规则的值作为限流key
+	Not *limitResource  `json:"not"` //规则组，子规则不匹配时匹配，不产生限流key
+
+	QPS    int `json:"qps"`    //该规则的QPS限制，规则中配置了任意限制时，替换插件配置的所有限制
+	Second int `json:"second"` //该规则的每秒请求限制，为空时使用qps
+	Minute int `json:"minute"` //该规则的每分钟请求限制
+	Hour   int `json:"hour"`   //该规则的每小时请求限制
+	Day    int `json:"day"`    //该规则的每天请求限制
+	Month  int `json:"month"`  //该规则的每月请求限制
+
+	patterns []string         //加载配置时解析出的匹配模式
+	regexps  []*regexp.Regexp //加载配置时编译好的正则，regex和glob使用
+	anyValue bool             //是否匹配任意值(value为空或包含*)
+	networks []*net.IPNet     //加载配置时解析好的ip及网段，ip类型使用
+
+	multipartTooLarge bool //匹配时multipart body超过MultipartMaxBytes，没有读取值
 }
 
 func New() interface{} {
@@ -95,37 +176,73 @@ func (conf Config) Access(kong *pdk.PDK) {
 		}
 	}()
 	_ = kong.Response.SetHeader("X-Rate-Limiting-Plugin-Version", version)
-	unix := time.Now().Unix()
+	now := time.Now()
 	//检查配置
 	if err := conf.checkConfig(); err != nil {
 		_ = kong.Log.Err("[checkConfig] ", err.Error())
 		return
 	}
 
+	//免限流的请求直接放行，不访问redis
+	if conf.isExempt(kong) {
+		if !conf.HideClientHeader {
+			_ = kong.Response.SetHeader(exemptHeader, "true")
+		}
+		return
+	}
 	//检查当前请求是否需要限流
-	limitKey, matched := conf.checkNeedRateLimit(kong)
+	limitKey, matchedResources, matched := conf.checkNeedRateLimit(kong)
 	if !matched {
 		return
 	}
+	//multipart body超过MultipartMaxBytes时拒绝请求
+	if conf.MultipartTooLarge == multipartTooLargeDeny && hasMultipartTooLarge(matchedResources) {
+		kong.Response.Exit(413, "Request body too large", nil)
+		return
+	}
+	//使用匹配到的规则中配置的限制
+	conf = conf.withRuleLimits(matchedResources)
 	//获取限制标识identifier
 	identifier, err := conf.getIdentifier(kong, limitKey)
 	if err != nil {
 		_ = kong.Log.Err("[getIdentifier] ", err.Error())
 		return
 	}
-	remaining, stop, err := conf.getRemainingAndIncr(kong, identifier, unix)
+	result, err := conf.getRemainingAndIncr(kong, identifier, now)
+	//redis有连续失败或熔断器没有关闭时将状态写入kong.ctx.shared，供日志及监控插件读取，hybrid策略在后台同步，请求不会出错，也需要输出
+	if conf.Policy != policyLocal {
+		if breaker := conf.getCircuitBreaker(); breaker.isUnhealthy() {
+			_ = kong.Ctx.SetShared(circuitBreakerSharedKey, breaker.stats())
+		}
+	}
 	if err != nil {
-		//出错只记录日志，不处理
 		_ = kong.Log.Err("[getUsage] ", err.Error())
-		return
+		//按OnStoreError处理，默认放行
+		switch conf.OnStoreError {
+		case onStoreErrorDeny:
+			kong.Response.Exit(conf.getStoreErrorStatus(), "API rate limit unavailable", nil)
+			return
+		case onStoreErrorLocal:
+			conf.Policy = policyLocal
+			if result, err = conf.getRemainingAndIncr(kong, identifier, now); err != nil {
+				return
+			}
+		default:
+			return
+		}
 	}
 	//如果设置不隐藏header,则输出到header
 	if !conf.HideClientHeader {
-		_ = kong.Response.SetHeader("X-Rate-Limiting-Limit-QPS", strconv.Itoa(conf.QPS))
-		_ = kong.Response.SetHeader("X-Rate-Limiting-Remaining", strconv.Itoa(remaining))
+		_ = kong.Response.SetHeader(result.window.limitHeader(), strconv.Itoa(result.window.limit))
+		_ = kong.Response.SetHeader("X-Rate-Limiting-Remaining", strconv.Itoa(result.remaining))
+		_ = kong.Response.SetHeader("X-Rate-Limiting-Reset", ceilSeconds(result.reset))
 	}
-	if stop {
-		kong.Response.Exit(429, "API rate limit exceeded", nil)
+	if result.stop {
+		var headers map[string][]string
+		if !conf.HideClientHeader {
+			headers = map[string][]string{"Retry-After": {ceilSeconds(result.reset)}}
+		}
+		kong.Response.Exit(429, "API rate limit exceeded", headers)
 		return
 	}
 }
@@ -133,27 +250,82 @@ func (conf Config) Access(kong *pdk.PDK) {
 //进入此插件，说明kong中已经启用插件
 func (conf Config) checkConfig() error {
 	validate := validator.New()
-	err := validate.Struct(conf)
+	var err error
+	if conf.Policy == policyLocal {
+		//本地策略不使用redis，不校验redis连接配置
+		err = validate.StructExcept(conf, "RedisHost", "RedisPort", "RedisTimeoutSecond")
+	} else {
+		err = validate.Struct(conf)
+	}
 	if err != nil {
 		return err
 	}
+	//令牌桶和gcra只按Rate限流，不支持多窗口
+	if (conf.Algorithm == algorithmTokenBucket || conf.Algorithm == algorithmGCRA) && conf.hasLongWindow() {
+		return errors.New(fmt.Sprintf("Minute, Hour, Day and Month are not supported by %s algorithm", conf.Algorithm))
+	}
+	//混合策略本地只保存计数器，只支持固定窗口
+	if conf.Policy == policyHybrid && conf.Algorithm != "" && conf.Algorithm != algorithmFixedWindow {
+		return errors.New(fmt.Sprintf("hybrid policy is not supported by %s algorithm", conf.Algorithm))
+	}
 	//如果MatchCondition为空，设置默认值为and
 	if conf.MatchCondition == "" {
 		conf.MatchCondition = matchConditionAnd
 	}
 
+	if _, err = conf.getRedisAddrs(); err != nil {
+		return err
+	}
+	if _, err = conf.getRedisTLSConfig(); err != nil {
+		return err
+	}
+	if _, err = conf.getTrustedProxies(); err != nil {
+		return err
+	}
+	if _, err = conf.getJwtPublicKeys(); err != nil {
+		return err
+	}
+	if _, err = conf.getExemptResources(); err != nil {
+		return err
+	}
+	_, err = conf.getLimitResources()
+	return err
+}
+
+//获取解析后的限流资源列表，配置没有变化时使用缓存
+func (conf Config) getLimitResources() ([]limitResource, error) {
+	cacheKey := conf.Algorithm + "\n" + conf.Path + "\n" + conf.LimitResourcesJson
+	if cached, ok := limitResourceCache.Load(cacheKey); ok {
+		return cached.([]limitResource), nil
+	}
+	resources, err := conf.parseLimitResources()
+	if err != nil {
+		return nil, err
+	}
+	limitResourceCache.Store(cacheKey, resources)
+	return resources, nil
+}
+
+//解析LimitResourcesJson及Path为限流资源列表
+func (conf Config) parseLimitResources() ([]limitResource, error) {
+	var resources []limitResource
+	//数组形式的规则数量，这些规则的错误提示中使用数组下标作为位置
+	arrayCount := 0
 	//允许流控规则为空
 	if conf.LimitResourcesJson != "" {
-		err = json.Unmarshal([]byte(conf.LimitResourcesJson), &limitResourceList)
+		var err error
+		//对象为一个规则树，数组为多个按MatchCondition组合的规则
+		if strings.HasPrefix(strings.TrimSpace(conf.LimitResourcesJson), "{") {
+			var root limitResource
+			err = json.Unmarshal([]byte(conf.LimitResourcesJson), &root)
+			resources = []limitResource{root}
+		} else {
+			err = json.Unmarshal([]byte(conf.LimitResourcesJson), &resources)
+			arrayCount = len(resources)
+		}
 		//json格式错误
 		if err != nil {
-			return errors.New(fmt.Sprintf("LimitResourcesJson with incorrect json format,%s", err.Error()))
-		}
-		//如果有值为空，则提示错误
-		for _, item := range limitResourceList {
-			if item.Type == "" || item.Key == "" || item.Value == "" {
-				return errors.New("LimitResourcesJson with empty value")
-			}
+			return nil, errors.New(fmt.Sprintf("LimitResourcesJson with incorrect json format,%s", err.Error()))
 		}
 	}
 	if conf.Path != "" {
@@ -163,57 +335,67 @@ func (conf Config) checkConfig() error {
 			Key:   "path",
 			Value: conf.Path,
 		}
-		limitResourceList = append(limitResourceList, queryPathLimitResource)
+		resources = append(resources, queryPathLimitResource)
 	}
-	return nil
+	//校验规则并编译匹配模式
+	for i := range resources {
+		path := ""
+		if i < arrayCount {
+			path = "[" + strconv.Itoa(i) + "]"
+		}
+		if err := conf.checkResource(&resources[i], path); err != nil {
+			return nil, err
+		}
+	}
+	return resources, nil
 }
 
 //获取剩余数量的同时加1
-func (conf Config) getRemainingAndIncr(kong *pdk.PDK, identifier string, unix int64) (remaining int, stop bool, err error) {
-	stop = false
-	remaining = 0
-	limitKey := conf.getRateLimitKey(identifier, unix)
+func (conf Config) getRemainingAndIncr(kong *pdk.PDK, identifier string, now time.Time) (result limitResult, err error) {
+	windows := conf.getLimitWindows(now)
+	luaScript, limitKeys, args := conf.getAlgorithmScript(identifier, windows, now)
 	if conf.Log {
-		_ = kong.Log.Err("[rateLimitKey] ", limitKey)
-	}
-	//第一次执行才设置有效期，如果过了有效期，则为下一时间段,使用lua保证原子性
-	luaScript := `
-		local key, value, expiration = KEYS[1], tonumber(ARGV[1]), ARGV[2]
-		local newVal = redis.call("incrby", key, value)
-		if newVal == value then
-			redis.call("expire", key, expiration)
-		end
-		return newVal - 1
-`
-	redisClient := conf.newRedisClient()
-	defer redisClient.Close()
-	result, err := redisClient.Eval(ctx, luaScript, []string{limitKey}, 1, 1).Result()
+		_ = kong.Log.Err("[rateLimitKey] ", strings.Join(limitKeys, ","))
+	}
+	var reply interface{}
+	switch conf.Policy {
+	case policyLocal:
+		reply, err = localStore.eval(conf.Algorithm, identifier, limitKeys, args, now)
+	case policyHybrid:
+		reply, err = hybridStore.hybridEval(conf, identifier, limitKeys, args, now)
+	default:
+		reply, err = conf.evalRedis(luaScript, limitKeys, args)
+	}
 	if err == redis.Nil {
-		return remaining, stop, nil
+		return result, nil
 	} else if err != nil {
-		return remaining, stop, err
-	} else {
-		int64Usage := result.(int64)
-		usageStr := strconv.FormatInt(int64Usage, 10)
-		intUsage, err := strconv.Atoi(usageStr)
-		if err != nil {
-			return remaining, stop, err
-		}
-		remaining = conf.QPS - intUsage
-		if remaining <= 0 {
-			stop = true
-			remaining = 0
-		} else {
-			//friendly show
-			remaining -= 1
-		}
-		return remaining, stop, nil
+		return result, err
 	}
+	return conf.parseAlgorithmResult(reply, windows, now)
 }
 
 //获取限流key
 func (conf Config) getRateLimitKey(identifier string, unix int64) string {
-	return conf.getPrefix() + identifier + ":" + rateLimitType + ":" + strconv.FormatInt(unix, 10)
+	return conf.getWindowRateLimitKey(identifier, windowSecond, unix)
+}
+
+//获取指定窗口的限流key
+func (conf Config) getWindowRateLimitKey(identifier string, window string, unix int64) string {
+	switch conf.Algorithm {
+	case algorithmSlidingWindowCounter:
+		return conf.getPrefix() + conf.getHashTag(identifier) + ":" + window + ":swc:" + strconv.FormatInt(unix, 10)
+	case algorithmSlidingWindowLog:
+		//滑动窗口日志所有窗口共用一个有序集合，不区分时间段
+		return conf.getPrefix() + conf.getHashTag(identifier) + ":" + rateLimitType + ":swl"
+	case algorithmTokenBucket:
+		//令牌桶使用一个hash保存令牌数和上次补充时间
+		return conf.getPrefix() + conf.getHashTag(identifier) + ":" + rateLimitType + ":tb"
+	case algorithmGCRA:
+		//GCRA每个标识只使用一个key，不会随时间产生新的key
+		return conf.getPrefix() + conf.getHashTag(identifier) + ":" + rateLimitType + ":gcra"
+	default:
+		return conf.getPrefix() + conf.getHashTag(identifier) + ":" + window + ":" + strconv.FormatInt(unix, 10)
+	}
 }
 
 //获取限流标识符
@@ -259,109 +441,289 @@ func (conf Config) getPrefix() string {
 	return prefix + rateLimitPrefix
 }
 
-//redis客户端
-func (conf Config) newRedisClient() *redis.Client {
+//创建redis客户端，请求中使用getRedisClient复用连接池
+func (conf Config) newRedisClient() redis.UniversalClient {
+	addrs, _ := conf.getRedisAddrs()
+	dialTimeout := time.Duration(conf.RedisTimeoutSecond) * time.Second
+	idleTimeout := time.Duration(conf.RedisIdleTimeoutSecond) * time.Second
+	tlsConfig, _ := conf.getRedisTLSConfig()
+	switch conf.RedisMode {
+	case redisModeCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        addrs,
+			Username:     conf.RedisUsername,
+			Password:     conf.RedisAuth,
+			DialTimeout:  dialTimeout,
+			PoolSize:     conf.RedisPoolSize,
+			MinIdleConns: conf.RedisMinIdleConns,
+			IdleTimeout:  idleTimeout,
+			TLSConfig:    tlsConfig,
+		})
+	case redisModeSentinel:
+		//通过哨兵获取master地址，主从切换后自动连接新的master
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       conf.RedisSentinelMaster,
+			SentinelAddrs:    addrs,
+			SentinelPassword: conf.RedisSentinelPassword,
+			Username:         conf.RedisUsername,
+			Password:         conf.RedisAuth,
+			DB:               conf.RedisDB,
+			DialTimeout:      dialTimeout,
+			PoolSize:         conf.RedisPoolSize,
+			MinIdleConns:     conf.RedisMinIdleConns,
+			IdleTimeout:      idleTimeout,
+			TLSConfig:        tlsConfig,
+		})
+	}
 	options := &redis.Options{
-		Addr:        conf.RedisHost + ":" + strconv.Itoa(conf.RedisPort),
-		Password:    conf.RedisAuth,
-		DB:          conf.RedisDB,
-		DialTimeout: time.Duration(conf.RedisTimeoutSecond) * time.Second,
+		Addr:         addrs[0],
+		Username:     conf.RedisUsername,
+		Password:     conf.RedisAuth,
+		DB:           conf.RedisDB,
+		DialTimeout:  dialTimeout,
+		PoolSize:     conf.RedisPoolSize,
+		MinIdleConns: conf.RedisMinIdleConns,
+		IdleTimeout:  idleTimeout,
+		TLSConfig:    tlsConfig,
 	}
 	return redis.NewClient(options)
 }
 
-//检查并返回是否需要限流的key
-func (conf Config) checkNeedRateLimit(kong *pdk.PDK) (limitKey string, matched bool) {
-	var matchedKey []string
-	for _, limitResource := range limitResourceList {
-		typeList := strings.Split(limitResource.Type, ",")
-		valueList := strings.Split(limitResource.Value, ",")
-		rateLimitValue, matched := conf.matchRateLimitValue(kong, limitResource.Key, typeList, valueList)
-		//如果匹配到了是or关系，返回匹配成功(如果没有配置MatchCondition，默认会为空字符串，默认匹配条件为and)
-		if matchConditionOr == conf.MatchCondition {
-			if matched {
-				return rateLimitValue, true
-			}
-		} else {
-			//否则是and的关系，没有匹配到，返回匹配失败，否则加入到数组中
-			if !matched {
-				return "", false
-			} else {
-				matchedKey = append(matchedKey, rateLimitValue)
-			}
+//获取redis节点地址，RedisHost:RedisPort为第一个节点，集群模式下为种子节点，哨兵模式下为哨兵节点
+func (conf Config) getRedisAddrs() ([]string, error) {
+	addrs := []string{net.JoinHostPort(conf.RedisHost, strconv.Itoa(conf.RedisPort))}
+	var name, nodes string
+	switch conf.RedisMode {
+	case redisModeCluster:
+		//集群只有db 0
+		if conf.RedisDB != 0 {
+			return nil, errors.New("RedisDB is not supported by cluster mode")
+		}
+		name, nodes = "RedisClusterNodes", conf.RedisClusterNodes
+	case redisModeSentinel:
+		if conf.RedisSentinelMaster == "" {
+			return nil, errors.New("RedisSentinelMaster is required by sentinel mode")
 		}
+		name, nodes = "RedisSentinelNodes", conf.RedisSentinelNodes
+	default:
+		return addrs, nil
+	}
+	for _, node := range strings.Split(nodes, ",") {
+		node = strings.TrimSpace(node)
+		if node == "" {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(node); err != nil || port == "" {
+			return nil, errors.New(fmt.Sprintf("%s with invalid address %s", name, node))
+		}
+		addrs = append(addrs, node)
+	}
+	return addrs, nil
+}
+
+//集群模式下使用hash tag包裹标识，保证一次lua脚本使用的所有key在同一个slot，避免CROSSSLOT错误
+func (conf Config) getHashTag(identifier string) string {
+	if conf.RedisMode == redisModeCluster {
+		return "{" + identifier + "}"
+	}
+	return identifier
+}
+
+//检查并返回是否需要限流的key及匹配到的规则
+func (conf Config) checkNeedRateLimit(kong *pdk.PDK) (limitKey string, matchedResources []limitResource, matched bool) {
+	limitResourceList, err := conf.getLimitResources()
+	if err != nil {
+		return "", nil, false
 	}
 	//如果limitResourceList为空(没有配置Path和LimitResourcesJson)，则返回匹配成功
+	if len(limitResourceList) == 0 {
+		return "", nil, true
+	}
+	//顶层规则按MatchCondition组合，or：匹配到一个则成功，否则为and(如果没有配置MatchCondition，默认会为空字符串，默认匹配条件为and)
+	root := limitResource{All: limitResourceList}
+	if matchConditionOr == conf.MatchCondition {
+		root = limitResource{Any: limitResourceList}
+	}
+	limitKeys, matchedResources, matched := conf.matchResource(kong, root)
+	if !matched {
+		return "", nil, false
+	}
 	//如果全匹配，则转为字符串返回
-	if len(limitResourceList) == len(matchedKey) {
-		return strings.Join(matchedKey, ":"), true
+	return strings.Join(limitKeys, ":"), matchedResources, true
+}
+
+//使用匹配到的规则中配置的限制替换插件配置的限制，and匹配到多个规则时每个窗口取最小的限制
+func (conf Config) withRuleLimits(resources []limitResource) Config {
+	var limits limitResource
+	found := false
+	for _, resource := range resources {
+		if !resource.hasLimit() {
+			continue
+		}
+		if !found {
+			limits = resource
+			limits.Second = resource.getSecondLimit()
+			found = true
+			continue
+		}
+		limits.Second = minLimit(limits.Second, resource.getSecondLimit())
+		limits.Minute = minLimit(limits.Minute, resource.Minute)
+		limits.Hour = minLimit(limits.Hour, resource.Hour)
+		limits.Day = minLimit(limits.Day, resource.Day)
+		limits.Month = minLimit(limits.Month, resource.Month)
+	}
+	if !found {
+		return conf
+	}
+	//令牌桶和gcra的补充速率跟随规则的每秒限制，按补充周期换算为每个周期的令牌数，配置了Burst时容量按Burst与补充速率的比例缩放
+	rate, burst, interval := conf.getTokenBucketParams()
+	ruleRate := limits.Second * int(interval/time.Second)
+	if conf.Burst > 0 && rate > 0 {
+		conf.Burst = int(math.Round(float64(ruleRate) * float64(burst) / float64(rate)))
+		if conf.Burst < 1 {
+			conf.Burst = 1
+		}
 	}
-	return "", false
+	conf.Rate = ruleRate
+	conf.QPS = limits.Second
+	conf.Second = limits.Second
+	conf.Minute = limits.Minute
+	conf.Hour = limits.Hour
+	conf.Day = limits.Day
+	conf.Month = limits.Month
+	return conf
 }
 
-//match rate limit key
-func (conf Config) matchRateLimitValue(kong *pdk.PDK, key string, typeList, valueList []string) (limitKey string, matched bool) {
+//规则中是否配置了限制
+func (resource limitResource) hasLimit() bool {
+	return resource.QPS > 0 || resource.Second > 0 || resource.Minute > 0 || resource.Hour > 0 || resource.Day > 0 || resource.Month > 0
+}
+
+//获取规则的每秒限制，second为空时使用qps
+func (resource limitResource) getSecondLimit() int {
+	if resource.Second > 0 {
+		return resource.Second
+	}
+	return resource.QPS
+}
+
+//使用values中匹配到的模式对应的QPS限制，没有单独配置时使用*的限制
+func (resource limitResource) withValueLimit(pattern string) limitResource {
+	if len(resource.Values) == 0 {
+		return resource
+	}
+	limit, ok := resource.Values[pattern]
+	if !ok {
+		limit = resource.Values["*"]
+	}
+	if limit > 0 {
+		resource.QPS = limit
+		resource.Second = 0
+	}
+	return resource
+}
+
+//取两个限制中较小的一个，0表示不限制
+func minLimit(a, b int) int {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+//match rate limit key，同时返回匹配到的模式，multipart body超过MultipartMaxBytes时按匹配处理并返回tooLarge
+func (conf Config) matchRateLimitValue(kong *pdk.PDK, resource limitResource) (limitKey string, pattern string, matched bool, tooLarge bool) {
+	typeList := strings.Split(resource.Type, ",")
 	for _, limitType := range typeList {
 		limitType = strings.ToLower(limitType)
-		switch limitType {
-		case "header":
-			find, err := kong.Request.GetHeader(key)
-			//获取失败，跳过
-			if err != nil {
-				continue
-			}
-			//如果请求头中存在被限制的列表，则返回
-			if inSlice(find, valueList) {
-				return find, true
-			}
-		case "query":
-			find, err := kong.Request.GetQueryArg(key)
-			//获取失败，跳过
-			if err != nil {
-				continue
-			}
-			//如果请求头中存在被限制的列表，则返回
-			if inSlice(find, valueList) {
-				return find, true
-			}
-		case "body":
-			rawBody, err := kong.Request.GetRawBody()
-			//获取失败，跳过
-			if err != nil {
-				continue
-			}
-			//TODO if json format or other raw format, maybe use contain judge or use equal after decode to key value pairs.
-			if !strings.Contains(rawBody, key) {
-				continue
-			}
-			bodySlice := strings.Split(rawBody, "&")
-			for _, value := range valueList {
-				limitValue := key + "=" + value
-				if inSlice(limitValue, bodySlice) {
-					return value, true
-				}
-			}
-		case "path":
-			find, err := kong.Request.GetPath()
-			//获取失败，跳过
-			if err != nil {
-				continue
+		findList, err := conf.getRequestValues(kong, limitType, resource.Key)
+		//body超过限制时不能读取值，按匹配处理，避免通过添加大文件绕过限流
+		if err == errMultipartTooLarge {
+			return multipartTooLargeKey, "*", true, true
+		}
+		//获取失败，跳过
+		if err != nil {
+			continue
+		}
+		//如果在被限制的列表，则返回
+		for _, find := range findList {
+			if limitType == "ip" {
+				limitKey, pattern, matched = resource.matchIp(find)
+			} else {
+				limitKey, pattern, matched = resource.matchValue(find)
 			}
-			//如果在被限制的列表，则返回
-			if inSlice(find, valueList) {
-				return find, true
+			if matched {
+				return limitKey, pattern, true, false
 			}
-		case "cookie":
-			//not support
-			continue
-		case "ip":
-			//next iteration will support
-			continue
-		default:
-			continue
 		}
 	}
-	return "", false
+	return "", "", false, false
+}
+
+//匹配到的规则中是否有multipart body超过MultipartMaxBytes的规则
+func hasMultipartTooLarge(resources []limitResource) bool {
+	for _, resource := range resources {
+		if resource.multipartTooLarge {
+			return true
+		}
+	}
+	return false
+}
+
+//获取请求中对应类型和key的值
+func (conf Config) getRequestValues(kong *pdk.PDK, limitType string, key string) ([]string, error) {
+	switch limitType {
+	case "header":
+		find, err := kong.Request.GetHeader(key)
+		return []string{find}, err
+	case "query":
+		find, err := kong.Request.GetQueryArg(key)
+		return []string{find}, err
+	case "body":
+		return conf.getBodyValues(kong, key)
+	case "path":
+		find, err := kong.Request.GetPath()
+		return []string{find}, err
+	case "cookie":
+		return getCookieValues(kong, key)
+	case "ip":
+		find, err := conf.getClientIp(kong)
+		return []string{find}, err
+	case "consumer":
+		return getConsumerValues(kong, key)
+	case "credential":
+		return getCredentialValues(kong, key)
+	case "authenticated_group":
+		return getAuthenticatedGroups(kong)
+	case "jwt_claim":
+		return conf.getJwtClaimValues(kong, key)
+	case "method":
+		find, err := kong.Request.GetMethod()
+		return []string{find}, err
+	case "host":
+		find, err := kong.Request.GetHost()
+		return []string{find}, err
+	case "scheme":
+		find, err := kong.Request.GetScheme()
+		return []string{find}, err
+	case "port":
+		port, err := kong.Request.GetPort()
+		if err != nil {
+			return nil, err
+		}
+		return []string{strconv.Itoa(port)}, nil
+	default:
+		return nil, nil
+	}
+}
+
+//将时间向上取整为秒，用于Retry-After等header
+func ceilSeconds(d time.Duration) string {
+	seconds := int64(d / time.Second)
+	if d%time.Second > 0 {
+		seconds++
+	}
+	return strconv.FormatInt(seconds, 10)
 }
 
 //是否在slice中
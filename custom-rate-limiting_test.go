@@ -1,9 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/Kong/go-pdk"
+	"github.com/Kong/go-pdk/bridge"
+	"github.com/Kong/go-pdk/client"
+	"github.com/Kong/go-pdk/entities"
 	"github.com/go-redis/redis/v8"
+	"reflect"
 	"strconv"
 	"sync"
 	"testing"
@@ -46,7 +51,8 @@ const wrongJsonNoHeader = `
 }]
 `
 
-const wrongJsonNoValue = `
+//value为空表示匹配任意值
+const jsonAnyValue = `
 [{
 "type": "header,cookie,get",
 "key": "keyName",
@@ -130,7 +136,7 @@ var configList = []TestConfig{
 			RedisLimitKeyPrefix: "",
 			HideClientHeader:    false,
 		},
-		confExpected:         "Key: 'Config.QPS' Error:Field validation for 'QPS' failed on the 'required' tag",
+		confExpected:         "Key: 'Config.QPS' Error:Field validation for 'QPS' failed on the 'required_without_all' tag",
 		prefixExpected:       "kong:customratelimit:",
 		identifier:           "",
 		unix:                 0,
@@ -300,7 +306,7 @@ var configList = []TestConfig{
 			RedisLimitKeyPrefix: "nicktest",
 			HideClientHeader:    false,
 		},
-		confExpected:         "LimitResourcesJson with empty value",
+		confExpected:         "LimitResourcesJson with empty value at [0]",
 		prefixExpected:       "nicktest:kong:customratelimit:",
 		identifier:           "username-nick",
 		unix:                 1600067356,
@@ -319,7 +325,7 @@ var configList = []TestConfig{
 			RedisLimitKeyPrefix: "nicktest",
 			HideClientHeader:    false,
 		},
-		confExpected:         "LimitResourcesJson with empty value",
+		confExpected:         "LimitResourcesJson with empty value at [0]",
 		prefixExpected:       "nicktest:kong:customratelimit:",
 		identifier:           "username-nick",
 		unix:                 1600067356,
@@ -329,7 +335,7 @@ var configList = []TestConfig{
 		input: Config{
 			QPS:                 30,
 			Log:                 true,
-			LimitResourcesJson:  wrongJsonNoValue,
+			LimitResourcesJson:  jsonAnyValue,
 			RedisHost:           redisHostRight,
 			RedisPort:           redisPortRight,
 			RedisAuth:           redisAuthRight,
@@ -338,7 +344,7 @@ var configList = []TestConfig{
 			RedisLimitKeyPrefix: "nicktest",
 			HideClientHeader:    false,
 		},
-		confExpected:         "LimitResourcesJson with empty value",
+		confExpected:         "",
 		prefixExpected:       "nicktest:kong:customratelimit:",
 		identifier:           "username-nick",
 		unix:                 1600067356,
@@ -404,6 +410,26 @@ var configList = []TestConfig{
 		unix:                 1600067356,
 		rateLimitKeyExpected: "nicktest:kong:customratelimit:username-nick:qps:1600067356",
 	},
+	{
+		input: Config{
+			QPS:                 30,
+			Log:                 true,
+			LimitResourcesJson:  jsonStr,
+			RedisHost:           redisHostRight,
+			RedisPort:           redisPortRight,
+			RedisAuth:           redisAuthRight,
+			RedisTimeoutSecond:  2,
+			RedisDB:             0,
+			RedisLimitKeyPrefix: "nicktest",
+			HideClientHeader:    false,
+			Algorithm:           "leaky-bucket",
+		},
+		confExpected:         "Key: 'Config.Algorithm' Error:Field validation for 'Algorithm' failed on the 'oneof' tag",
+		prefixExpected:       "nicktest:kong:customratelimit:",
+		identifier:           "username-nick",
+		unix:                 1600067356,
+		rateLimitKeyExpected: "nicktest:kong:customratelimit:username-nick:qps:1600067356",
+	},
 }
 
 func TestCheckConfig(t *testing.T) {
@@ -454,9 +480,9 @@ func getDefaultConf() *Config {
 func TestGetRemainingAndIncr(t *testing.T) {
 	kong := &pdk.PDK{}
 	conf := getDefaultConf()
-	remaining, stop, _ := conf.getRemainingAndIncr(kong, "username-nick", 1600067356)
-	if remaining != 30 && stop != false {
-		t.Errorf("getRemainingAndIncr return: [%v %v], rateLimitKeyExpected: [%v %v]", remaining, stop, 30, false)
+	result, _ := conf.getRemainingAndIncr(kong, "username-nick", time.Unix(1600067356, 0))
+	if result.remaining != 30 && result.stop != false {
+		t.Errorf("getRemainingAndIncr return: [%v %v], rateLimitKeyExpected: [%v %v]", result.remaining, result.stop, 30, false)
 	}
 }
 
@@ -467,8 +493,8 @@ func TestGetRemainingAndIncrConcurrent(t *testing.T) {
 	for i := 0; i <= 100; i++ {
 		wg.Add(1)
 		go func(i int) {
-			remaining, stop, _ := conf.getRemainingAndIncr(kong, "username-nick", 1600067356)
-			fmt.Println(remaining, stop)
+			result, _ := conf.getRemainingAndIncr(kong, "username-nick", time.Unix(1600067356, 0))
+			fmt.Println(result.remaining, result.stop)
 			wg.Done()
 		}(i)
 	}
@@ -527,6 +553,346 @@ func TestInSlice(t *testing.T) {
 	}
 }
 
+func TestWithRuleLimits(t *testing.T) {
+	list := []struct {
+		resources []limitResource
+		expected  []limitWindow
+	}{
+		{
+			//规则中没有配置限制，使用插件配置
+			resources: []limitResource{{Type: "header", Key: "X-Tenant", Value: "free"}},
+			expected:  []limitWindow{{name: windowSecond, limit: 30}},
+		},
+		{
+			resources: []limitResource{{Type: "header", Key: "X-Tenant", Value: "gold", QPS: 1000}},
+			expected:  []limitWindow{{name: windowSecond, limit: 1000}},
+		},
+		{
+			resources: []limitResource{{Type: "header", Key: "X-Tenant", Value: "gold", QPS: 1000, Minute: 5000}},
+			expected:  []limitWindow{{name: windowSecond, limit: 1000}, {name: windowMinute, limit: 5000}},
+		},
+		{
+			//and匹配到多个规则时每个窗口取最小的限制
+			resources: []limitResource{
+				{Type: "header", Key: "X-Tenant", Value: "gold", QPS: 1000, Minute: 5000},
+				{Type: "query", Key: "orderId", Value: "order1", Second: 100, Day: 20000},
+			},
+			expected: []limitWindow{{name: windowSecond, limit: 100}, {name: windowMinute, limit: 5000}, {name: windowDay, limit: 20000}},
+		},
+	}
+	for i, val := range list {
+		conf := getDefaultConf().withRuleLimits(val.resources)
+		windows := conf.getLimitWindows(time.Now())
+		if len(windows) != len(val.expected) {
+			t.Errorf("withRuleLimits %d return %d windows, expected: %d", i, len(windows), len(val.expected))
+			continue
+		}
+		for j, window := range windows {
+			if window.name != val.expected[j].name || window.limit != val.expected[j].limit {
+				t.Errorf("withRuleLimits %d return: [%s %d], expected: [%s %d]", i, window.name, window.limit, val.expected[j].name, val.expected[j].limit)
+			}
+		}
+	}
+}
+
+func TestWithRuleLimitsWithTokenBucket(t *testing.T) {
+	list := []struct {
+		rate         int
+		burst        int
+		interval     int
+		qps          int
+		expectedRate int
+		expected     int
+	}{
+		//没有配置Burst时容量等于规则的限制
+		{0, 0, 0, 1000, 1000, 1000},
+		{10, 0, 0, 1000, 1000, 1000},
+		//保持Burst与补充速率的比例
+		{10, 50, 0, 1000, 1000, 5000},
+		{0, 60, 0, 1000, 1000, 2000},
+		{100, 10, 0, 5, 5, 1},
+		//规则的qps为每秒限制，按补充周期换算
+		{0, 0, 60, 10, 600, 600},
+		{10, 50, 60, 10, 600, 3000},
+	}
+	for _, val := range list {
+		conf := getDefaultConf()
+		conf.Algorithm = algorithmTokenBucket
+		conf.Rate = val.rate
+		conf.Burst = val.burst
+		conf.RefillIntervalSecond = val.interval
+		ruleConf := conf.withRuleLimits([]limitResource{{Type: "header", Key: "X-Tenant", Value: "gold", QPS: val.qps}})
+		rate, burst, _ := ruleConf.getTokenBucketParams()
+		if rate != val.expectedRate || burst != val.expected {
+			t.Errorf("withRuleLimits with Rate [%d] Burst [%d] RefillIntervalSecond [%d] return: [%d %d], expected: [%d %d]", val.rate, val.burst, val.interval, rate, burst, val.expectedRate, val.expected)
+		}
+	}
+}
+
+func TestCheckConfigWithRuleLimits(t *testing.T) {
+	list := []struct {
+		algorithm string
+		json      string
+		expected  string
+	}{
+		{
+			json:     `[{"type": "header", "key": "X-Tenant", "value": "gold", "qps": 1000}, {"type": "header", "key": "X-Tenant", "value": "free", "qps": 10}]`,
+			expected: "",
+		},
+		{
+			json:     `[{"type": "header", "key": "X-Tenant", "value": "gold", "qps": -1}]`,
+			expected: "LimitResourcesJson with negative limit at [0]",
+		},
+		{
+			json:     `[{"type": "body", "key": "orderId", "values": {"orderA": 5, "orderB": 50, "*": 10}}]`,
+			expected: "",
+		},
+		{
+			json:     `[{"type": "body", "key": "orderId", "values": {"orderA": -5}}]`,
+			expected: "LimitResourcesJson with negative limit at [0]",
+		},
+		{
+			algorithm: algorithmTokenBucket,
+			json:      `[{"type": "header", "key": "X-Tenant", "value": "gold", "minute": 1000}]`,
+			expected:  "LimitResourcesJson with minute, hour, day or month limit which is not supported by token-bucket algorithm at [0]",
+		},
+	}
+	for _, val := range list {
+		conf := getDefaultConf()
+		conf.Algorithm = val.algorithm
+		conf.LimitResourcesJson = val.json
+		err := conf.checkConfig()
+		if (err == nil && val.expected != "") || (err != nil && err.Error() != val.expected) {
+			t.Errorf("checkConfig return: [%v], expected: [%s]", err, val.expected)
+		}
+	}
+}
+
+func TestWithValueLimit(t *testing.T) {
+	resource := limitResource{
+		Type:   "body",
+		Key:    "orderId",
+		QPS:    100,
+		Minute: 1000,
+		Values: map[string]int{"orderA": 5, "orderB": 50, "orderC": 0, "*": 10},
+	}
+	list := []struct {
+		value    string
+		expected int
+	}{
+		{"orderA", 5},
+		{"orderB", 50},
+		//0表示使用规则的限制
+		{"orderC", 100},
+		{"orderD", 10},
+	}
+	for _, val := range list {
+		actual := resource.withValueLimit(val.value)
+		if actual.getSecondLimit() != val.expected || actual.Minute != 1000 {
+			t.Errorf("withValueLimit [%s] return: [%d %d], expected: [%d %d]", val.value, actual.getSecondLimit(), actual.Minute, val.expected, 1000)
+		}
+	}
+}
+
+func TestGetRedisAddrs(t *testing.T) {
+	list := []struct {
+		mode          string
+		nodes         string
+		db            int
+		expected      []string
+		expectedError string
+	}{
+		{"", "10.0.0.2:6379", 0, []string{"127.0.0.1:6379"}, ""},
+		{redisModeCluster, "10.0.0.2:6379, 10.0.0.3:6380,", 0, []string{"127.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6380"}, ""},
+		{redisModeCluster, "10.0.0.2", 0, nil, "RedisClusterNodes with invalid address 10.0.0.2"},
+		{redisModeCluster, "", 1, nil, "RedisDB is not supported by cluster mode"},
+		{redisModeSentinel, "10.0.0.2:26379", 1, []string{"127.0.0.1:6379", "10.0.0.2:26379"}, ""},
+		{redisModeSentinel, "10.0.0.2", 0, nil, "RedisSentinelNodes with invalid address 10.0.0.2"},
+	}
+	for _, val := range list {
+		conf := getDefaultConf()
+		conf.RedisHost = "127.0.0.1"
+		conf.RedisPort = 6379
+		conf.RedisMode = val.mode
+		conf.RedisClusterNodes = val.nodes
+		conf.RedisSentinelNodes = val.nodes
+		conf.RedisSentinelMaster = "mymaster"
+		conf.RedisDB = val.db
+		actual, err := conf.getRedisAddrs()
+		if val.expectedError != "" {
+			if err == nil || err.Error() != val.expectedError {
+				t.Errorf("getRedisAddrs return: [%v], expected: [%s]", err, val.expectedError)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(actual, val.expected) {
+			t.Errorf("getRedisAddrs return: [%v %v], expected: [%v]", actual, err, val.expected)
+		}
+	}
+}
+
+func TestCheckConfigWithSentinel(t *testing.T) {
+	conf := getDefaultConf()
+	conf.RedisMode = redisModeSentinel
+	if err := conf.checkConfig(); err == nil || err.Error() != "RedisSentinelMaster is required by sentinel mode" {
+		t.Errorf("checkConfig return: [%v], expected: [%s]", err, "RedisSentinelMaster is required by sentinel mode")
+	}
+	conf.RedisSentinelMaster = "mymaster"
+	if err := conf.checkConfig(); err != nil {
+		t.Errorf("checkConfig with sentinel failed, %s", err.Error())
+	}
+}
+
+func TestGetRateLimitKeyWithCluster(t *testing.T) {
+	conf := getDefaultConf()
+	conf.RedisMode = redisModeCluster
+	conf.Algorithm = algorithmSlidingWindowCounter
+	expected := "nicktest:kong:customratelimit:{username-nick}:minute:swc:1600067340"
+	if actual := conf.getWindowRateLimitKey("username-nick", windowMinute, 1600067340); actual != expected {
+		t.Errorf("getWindowRateLimitKey with cluster return: [%s], expected: [%s]", actual, expected)
+	}
+}
+
+//模拟kong的pdk调用，replies为方法名对应的返回值或按参数返回值的函数，未配置的方法返回错误
+func newMockPdk(replies map[string]interface{}) *pdk.PDK {
+	kong, _ := newRecordingMockPdk(replies)
+	return kong
+}
+
+//模拟kong的pdk调用并记录所有调用，kong.response.exit会结束模拟
+func newRecordingMockPdk(replies map[string]interface{}) (*pdk.PDK, func() []bridge.StepData) {
+	ch := make(chan interface{})
+	done := make(chan struct{})
+	var lock sync.Mutex
+	var steps []bridge.StepData
+	go func() {
+		defer close(done)
+		for call := range ch {
+			step, ok := call.(bridge.StepData)
+			if !ok {
+				return
+			}
+			lock.Lock()
+			steps = append(steps, step)
+			lock.Unlock()
+			if step.Method == "kong.response.exit" {
+				return
+			}
+			reply, ok := replies[step.Method]
+			if !ok {
+				reply = errors.New("not mocked: " + step.Method)
+			}
+			//按参数返回不同的值，如不同名称的header
+			if replyFunc, ok := reply.(func(args []interface{}) interface{}); ok {
+				reply = replyFunc(step.Args)
+			}
+			ch <- reply
+		}
+	}()
+	return pdk.Init(ch), func() []bridge.StepData {
+		//等待kong.response.exit被记录
+		select {
+		case <-done:
+		case <-time.After(100 * time.Millisecond):
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]bridge.StepData(nil), steps...)
+	}
+}
+
+func TestGetRequestValuesWithRequestInfo(t *testing.T) {
+	kong := newMockPdk(map[string]interface{}{
+		"kong.request.get_method": "POST",
+		"kong.request.get_host":   "api.partner.com",
+		"kong.request.get_scheme": "https",
+		"kong.request.get_port":   8443,
+	})
+	conf := getDefaultConf()
+	list := []struct {
+		limitType string
+		expected  string
+	}{
+		{"method", "POST"},
+		{"host", "api.partner.com"},
+		{"scheme", "https"},
+		{"port", "8443"},
+	}
+	for _, val := range list {
+		findList, err := conf.getRequestValues(kong, val.limitType, val.limitType)
+		if err != nil || len(findList) != 1 || findList[0] != val.expected {
+			t.Errorf("getRequestValues [%s] return: [%v %v], expected: [%s]", val.limitType, findList, err, val.expected)
+		}
+	}
+}
+
+func TestGetRequestValuesWithConsumer(t *testing.T) {
+	kong := newMockPdk(map[string]interface{}{
+		"kong.client.get_consumer":   entities.Consumer{Id: "c-1", Username: "partner-a", CustomId: "custom-1"},
+		"kong.client.get_credential": client.AuthenticatedCredential{Id: "cred-1", ConsumerId: "c-1"},
+		"kong.ctx.shared.get":        []interface{}{"gold", " silver "},
+	})
+	conf := getDefaultConf()
+	list := []struct {
+		limitType string
+		key       string
+		expected  []string
+	}{
+		{"consumer", "id", []string{"c-1"}},
+		{"consumer", "username", []string{"partner-a"}},
+		{"consumer", "custom_id", []string{"custom-1"}},
+		{"consumer", "consumer", []string{"c-1", "partner-a"}},
+		{"credential", "id", []string{"cred-1"}},
+		{"credential", "consumer_id", []string{"c-1"}},
+		{"authenticated_group", "group", []string{"gold", "silver"}},
+	}
+	for _, val := range list {
+		findList, err := conf.getRequestValues(kong, val.limitType, val.key)
+		if err != nil || !reflect.DeepEqual(findList, val.expected) {
+			t.Errorf("getRequestValues [%s %s] return: [%v %v], expected: [%v]", val.limitType, val.key, findList, err, val.expected)
+		}
+	}
+	//匿名请求没有consumer，不匹配
+	kong = newMockPdk(map[string]interface{}{
+		"kong.client.get_consumer": nil,
+		"kong.ctx.shared.get":      "gold,silver",
+	})
+	if findList, err := conf.getRequestValues(kong, "consumer", "username"); err == nil {
+		t.Errorf("getRequestValues without consumer return: [%v], expected error", findList)
+	}
+	if findList, _ := conf.getRequestValues(kong, "authenticated_group", "group"); !reflect.DeepEqual(findList, []string{"gold", "silver"}) {
+		t.Errorf("getRequestValues [authenticated_group] return: [%v], expected: [%v]", findList, []string{"gold", "silver"})
+	}
+}
+
+func TestCheckNeedRateLimitWithMethod(t *testing.T) {
+	list := []struct {
+		method   string
+		path     string
+		expected bool
+	}{
+		{"POST", "/orders", true},
+		{"GET", "/orders", false},
+		{"POST", "/users", false},
+	}
+	for _, val := range list {
+		kong := newMockPdk(map[string]interface{}{
+			"kong.request.get_method": val.method,
+			"kong.request.get_path":   val.path,
+		})
+		conf := getDefaultConf()
+		conf.Path = "/orders"
+		conf.LimitResourcesJson = `[{"type": "method", "key": "method", "value": "POST,PUT"}]`
+		limitKey, _, matched := conf.checkNeedRateLimit(kong)
+		if matched != val.expected {
+			t.Errorf("checkNeedRateLimit [%s %s] return: [%v], expected: [%v]", val.method, val.path, matched, val.expected)
+		}
+		if matched && limitKey != "POST:/orders" {
+			t.Errorf("checkNeedRateLimit [%s %s] return key: [%s], expected: [%s]", val.method, val.path, limitKey, "POST:/orders")
+		}
+	}
+}
+
 func TestRedisEval(t *testing.T) {
 	options := &redis.Options{
 		Addr:        redisHostRight + ":" + strconv.Itoa(redisPortRight),
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Kong/go-pdk"
+	"strconv"
+	"strings"
+)
+
+//解析后的免限流规则缓存，key为影响解析结果的配置
+var exemptResourceCache = newBoundedCache(configCacheSize)
+
+//免限流时返回给客户端的header
+const exemptHeader = "X-Rate-Limiting-Exempt"
+
+//当前请求是否免限流，匹配到免限流名单或ExcludeResourcesJson中任意一个规则即免限流
+func (conf Config) isExempt(kong *pdk.PDK) bool {
+	resources, err := conf.getExemptResources()
+	if err != nil || len(resources) == 0 {
+		return false
+	}
+	_, _, matched := conf.matchResource(kong, limitResource{Any: resources})
+	return matched
+}
+
+//获取解析后的免限流规则，配置没有变化时使用缓存
+func (conf Config) getExemptResources() ([]limitResource, error) {
+	cacheKey := strings.Join([]string{conf.BypassIps, conf.BypassConsumers, conf.BypassHeaders, conf.ExcludeResourcesJson}, "\n")
+	if cached, ok := exemptResourceCache.Load(cacheKey); ok {
+		return cached.([]limitResource), nil
+	}
+	resources, err := conf.parseExemptResources()
+	if err != nil {
+		return nil, err
+	}
+	exemptResourceCache.Store(cacheKey, resources)
+	return resources, nil
+}
+
+//将免限流名单及ExcludeResourcesJson解析为规则列表
+func (conf Config) parseExemptResources() ([]limitResource, error) {
+	var resources []limitResource
+	if conf.BypassIps != "" {
+		resources = append(resources, limitResource{Type: "ip", Key: "ip", Value: conf.BypassIps})
+	}
+	if conf.BypassConsumers != "" {
+		resources = append(resources, limitResource{Type: "consumer", Key: "consumer", Value: conf.BypassConsumers})
+	}
+	//格式为name:value，value为空时只要有该header即免限流
+	for _, item := range strings.Split(conf.BypassHeaders, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		index := strings.Index(item, ":")
+		if index <= 0 {
+			return nil, errors.New(fmt.Sprintf("BypassHeaders with invalid header %s", item))
+		}
+		resources = append(resources, limitResource{Type: "header", Key: strings.TrimSpace(item[:index]), Value: strings.TrimSpace(item[index+1:])})
+	}
+	//名单都是完全相等匹配，只有ip可能解析失败
+	for i := range resources {
+		if err := resources[i].compile(); err != nil {
+			return nil, errors.New("BypassIps" + strings.TrimPrefix(err.Error(), "LimitResourcesJson"))
+		}
+	}
+	if conf.ExcludeResourcesJson != "" {
+		var excludes []limitResource
+		var err error
+		isArray := false
+		//与LimitResourcesJson相同，对象为一个规则树，数组中的规则匹配任意一个即免限流
+		if strings.HasPrefix(strings.TrimSpace(conf.ExcludeResourcesJson), "{") {
+			var root limitResource
+			err = json.Unmarshal([]byte(conf.ExcludeResourcesJson), &root)
+			excludes = []limitResource{root}
+		} else {
+			err = json.Unmarshal([]byte(conf.ExcludeResourcesJson), &excludes)
+			isArray = true
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("ExcludeResourcesJson with incorrect json format,%s", err.Error()))
+		}
+		for i := range excludes {
+			path := ""
+			if isArray {
+				path = "[" + strconv.Itoa(i) + "]"
+			}
+			if err := conf.checkResource(&excludes[i], path); err != nil {
+				return nil, errors.New("ExcludeResourcesJson" + strings.TrimPrefix(err.Error(), "LimitResourcesJson"))
+			}
+		}
+		resources = append(resources, excludes...)
+	}
+	return resources, nil
+}
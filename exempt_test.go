@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/Kong/go-pdk/entities"
+	"testing"
+)
+
+func TestIsExempt(t *testing.T) {
+	conf := getDefaultConf()
+	conf.BypassIps = "10.0.0.0/8,127.0.0.1"
+	conf.BypassConsumers = "internal-service"
+	conf.BypassHeaders = "X-Health-Check:,X-Internal: true"
+	conf.ExcludeResourcesJson = `[{"type": "path", "key": "path", "value": "/health,/metrics"}]`
+	list := []struct {
+		name     string
+		replies  map[string]interface{}
+		expected bool
+	}{
+		{"ip", map[string]interface{}{"kong.client.get_forwarded_ip": "10.1.2.3"}, true},
+		{"consumer", map[string]interface{}{"kong.client.get_consumer": entities.Consumer{Id: "c-1", Username: "internal-service"}}, true},
+		{"header", map[string]interface{}{"kong.request.get_header": "true"}, true},
+		{"path", map[string]interface{}{"kong.request.get_header": "", "kong.request.get_path": "/health"}, true},
+		{"none", map[string]interface{}{
+			"kong.client.get_forwarded_ip": "1.1.1.1",
+			"kong.client.get_consumer":     entities.Consumer{Id: "c-2", Username: "partner-a"},
+			"kong.request.get_header":      "",
+			"kong.request.get_path":        "/orders",
+		}, false},
+	}
+	for _, val := range list {
+		if actual := conf.isExempt(newMockPdk(val.replies)); actual != val.expected {
+			t.Errorf("isExempt [%s] return: [%v], expected: [%v]", val.name, actual, val.expected)
+		}
+	}
+	//没有配置免限流时不调用pdk
+	if getDefaultConf().isExempt(newMockPdk(nil)) {
+		t.Errorf("isExempt without config return: [%v], expected: [%v]", true, false)
+	}
+}
+
+func TestCheckConfigWithExempt(t *testing.T) {
+	list := []struct {
+		bypassIps     string
+		bypassHeaders string
+		excludeJson   string
+		expected      string
+	}{
+		{"10.0.0.0/8", "X-Internal:1", `{"not": {"type": "header", "key": "X-Tenant"}}`, ""},
+		{"10.0.0", "", "", "BypassIps with invalid ip or cidr 10.0.0"},
+		{"", "X-Internal", "", "BypassHeaders with invalid header X-Internal"},
+		{"", "", `[{"type": "path"}]`, "ExcludeResourcesJson with empty value at [0]"},
+		{"", "", `{"any": [{"type": "path"}]}`, "ExcludeResourcesJson with empty value at any[0]"},
+		{"", "", `[{type: "path"}]`, "ExcludeResourcesJson with incorrect json format,invalid character 't' looking for beginning of object key string"},
+	}
+	for _, val := range list {
+		conf := getDefaultConf()
+		conf.BypassIps = val.bypassIps
+		conf.BypassHeaders = val.bypassHeaders
+		conf.ExcludeResourcesJson = val.excludeJson
+		err := conf.checkConfig()
+		actual := ""
+		if err != nil {
+			actual = err.Error()
+		}
+		if actual != val.expected {
+			t.Errorf("checkConfig return: [%s], expected: [%s]", actual, val.expected)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"container/heap"
+	"github.com/go-redis/redis/v8"
+	"sync"
+	"time"
+)
+
+//限流策略:本地计数并定期同步到redis，减少每个请求访问redis的延迟，计数有一定误差
+const policyHybrid = "hybrid"
+
+//混合策略默认的同步间隔
+const defaultSyncInterval = time.Second
+
+//混合策略在key过期前提前同步的时间，保证秒窗口等短窗口的计数在过期前同步到redis
+const hybridSyncLead = 100 * time.Millisecond
+
+//混合策略后台检查到达同步时间的key的间隔，需小于hybridSyncLead
+const hybridSyncTick = 50 * time.Millisecond
+
+//混合策略每次pipeline同步的最大key数
+const hybridSyncBatchSize = 500
+
+//同步本地计数的lua脚本，将本地新增的计数加到redis中并返回全局计数，key不存在有效期时设置有效期
+const hybridSyncScript = `
+		local value = redis.call("incrby", KEYS[1], ARGV[1])
+		if redis.call("ttl", KEYS[1]) < 0 then
+			redis.call("expire", KEYS[1], ARGV[2])
+		end
+		return value
+`
+
+//进程内的混合策略计数
+var hybridStore = newLocalLimitStore(localShardCount)
+
+//获取同步间隔
+func (conf Config) getSyncInterval() time.Duration {
+	if conf.SyncIntervalMillisecond > 0 {
+		return time.Duration(conf.SyncIntervalMillisecond) * time.Millisecond
+	}
+	return defaultSyncInterval
+}
+
+//混合策略的固定窗口计数，返回值与fixedWindowScript相同，有未同步的计数时由后台协程按同步间隔批量同步，未同步的计数达到MaxDrift时立即在后台同步
+func (store *localLimitStore) hybridEval(conf Config, identifier string, keys []string, args []interface{}, now time.Time) (interface{}, error) {
+	store.startSync()
+	shard := store.getShard(identifier)
+	shard.Lock()
+	shard.sweep(now)
+	usages := make([]interface{}, len(keys))
+	var syncConf *Config
+	wake := false
+	for i, key := range keys {
+		entry := shard.getOrCreate(key, now)
+		if entry.expireAt.IsZero() {
+			entry.expireAt = now.Add(time.Duration(argInt64(args[i])) * time.Second)
+		}
+		//全局计数+同步中的计数+本地未同步的计数
+		usages[i] = entry.synced + entry.pending + entry.counter
+		entry.counter++
+		syncAt := entry.nextSyncAt(conf.getSyncInterval(), now)
+		if conf.MaxDrift > 0 && entry.counter >= int64(conf.MaxDrift) {
+			syncAt = now
+			wake = true
+		}
+		//只在key需要重新安排同步时复制配置
+		if entry.syncAt.IsZero() || syncAt.Before(entry.syncAt) {
+			if syncConf == nil {
+				copied := conf
+				syncConf = &copied
+			}
+			shard.scheduleSync(syncConf, key, entry, syncAt)
+		}
+	}
+	shard.Unlock()
+	if wake {
+		store.wakeSync()
+	}
+	return usages, nil
+}
+
+//下次同步的时间，同步间隔内过期的key在过期前同步
+func (entry *localEntry) nextSyncAt(interval time.Duration, now time.Time) time.Time {
+	syncAt := now.Add(interval)
+	if !entry.expireAt.IsZero() {
+		if beforeExpire := entry.expireAt.Add(-hybridSyncLead); beforeExpire.Before(syncAt) {
+			syncAt = beforeExpire
+		}
+	}
+	return syncAt
+}
+
+//安排key在syncAt时同步，已安排了更早的同步时不处理，调用方需持有锁
+func (shard *localShard) scheduleSync(conf *Config, key string, entry *localEntry, syncAt time.Time) {
+	if !entry.syncAt.IsZero() && !syncAt.Before(entry.syncAt) {
+		return
+	}
+	entry.syncAt = syncAt
+	entry.syncConf = conf
+	heap.Push(&shard.syncQueue, hybridSyncItem{key: key, entry: entry, syncAt: syncAt})
+}
+
+//等待同步的key
+type hybridSyncItem struct {
+	key    string
+	entry  *localEntry
+	syncAt time.Time
+}
+
+//等待同步的key，按同步时间排序的最小堆
+type hybridSyncQueue []hybridSyncItem
+
+func (queue hybridSyncQueue) Len() int {
+	return len(queue)
+}
+
+func (queue hybridSyncQueue) Less(i, j int) bool {
+	return queue[i].syncAt.Before(queue[j].syncAt)
+}
+
+func (queue hybridSyncQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+}
+
+func (queue *hybridSyncQueue) Push(item interface{}) {
+	*queue = append(*queue, item.(hybridSyncItem))
+}
+
+func (queue *hybridSyncQueue) Pop() interface{} {
+	old := *queue
+	item := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return item
+}
+
+//一个key的同步任务
+type hybridSyncTask struct {
+	shard   *localShard
+	key     string
+	entry   *localEntry
+	conf    *Config
+	pending int64 //同步到redis的计数
+	expire  string
+}
+
+//启动后台同步协程，每个store只有一个
+func (store *localLimitStore) startSync() {
+	store.syncOnce.Do(func() {
+		store.syncWake = make(chan struct{}, 1)
+		go store.syncLoop()
+	})
+}
+
+//唤醒后台同步协程，立即同步到达同步时间的key
+func (store *localLimitStore) wakeSync() {
+	select {
+	case store.syncWake <- struct{}{}:
+	default:
+	}
+}
+
+//后台同步协程，定期将到达同步时间的key批量同步到redis
+func (store *localLimitStore) syncLoop() {
+	ticker := time.NewTicker(hybridSyncTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-store.syncWake:
+		}
+		store.flushDue(time.Now())
+	}
+}
+
+//同步到达同步时间的key，同一个redis的key通过pipeline批量同步，不同redis并发同步
+func (store *localLimitStore) flushDue(now time.Time) {
+	var wg sync.WaitGroup
+	for _, tasks := range groupSyncTasks(store.takeDueSyncs(now)) {
+		wg.Add(1)
+		go func(tasks []*hybridSyncTask) {
+			defer wg.Done()
+			_ = store.flushSync(*tasks[0].conf, tasks)
+		}(tasks)
+	}
+	wg.Wait()
+}
+
+//取出到达同步时间的key的本地计数并标记为同步中，已过期、已重新安排或正在同步的key跳过
+func (store *localLimitStore) takeDueSyncs(now time.Time) []*hybridSyncTask {
+	var tasks []*hybridSyncTask
+	for _, shard := range store.shards {
+		shard.Lock()
+		for len(shard.syncQueue) > 0 && !shard.syncQueue[0].syncAt.After(now) {
+			item := heap.Pop(&shard.syncQueue).(hybridSyncItem)
+			entry := item.entry
+			if !entry.syncAt.Equal(item.syncAt) {
+				continue
+			}
+			entry.syncAt = time.Time{}
+			//已过期被清理的key不再同步，正在同步的key在同步结束后重新安排
+			if shard.get(item.key, now) != entry || entry.syncing || entry.counter == 0 {
+				continue
+			}
+			entry.pending, entry.counter = entry.counter, 0
+			entry.syncing = true
+			expire := entry.expireAt.Sub(now)
+			if expire < time.Second {
+				expire = time.Second
+			}
+			tasks = append(tasks, &hybridSyncTask{
+				shard:   shard,
+				key:     item.key,
+				entry:   entry,
+				conf:    entry.syncConf,
+				pending: entry.pending,
+				expire:  ceilSeconds(expire),
+			})
+		}
+		shard.Unlock()
+	}
+	return tasks
+}
+
+//按redis连接配置分组，每组最多hybridSyncBatchSize个key
+func groupSyncTasks(tasks []*hybridSyncTask) [][]*hybridSyncTask {
+	clientKeys := map[*Config]string{}
+	groups := map[string][]*hybridSyncTask{}
+	var order []string
+	for _, task := range tasks {
+		clientKey, ok := clientKeys[task.conf]
+		if !ok {
+			clientKey = task.conf.getRedisClientKey()
+			clientKeys[task.conf] = clientKey
+		}
+		if _, ok := groups[clientKey]; !ok {
+			order = append(order, clientKey)
+		}
+		groups[clientKey] = append(groups[clientKey], task)
+	}
+	var batches [][]*hybridSyncTask
+	for _, clientKey := range order {
+		group := groups[clientKey]
+		for len(group) > hybridSyncBatchSize {
+			batches = append(batches, group[:hybridSyncBatchSize])
+			group = group[hybridSyncBatchSize:]
+		}
+		batches = append(batches, group)
+	}
+	return batches
+}
+
+//将取出的计数通过一次pipeline同步到redis，同步失败的计数放回本地，下个同步间隔再同步
+func (store *localLimitStore) flushSync(conf Config, tasks []*hybridSyncTask) error {
+	cmds, err := conf.pipelineRedis(func(pipe redis.Pipeliner) {
+		for _, task := range tasks {
+			pipe.Eval(ctx, hybridSyncScript, []string{task.key}, task.pending, task.expire)
+		}
+	})
+	now := time.Now()
+	for i, task := range tasks {
+		var value int64
+		taskErr := err
+		if len(cmds) == len(tasks) {
+			value, taskErr = cmds[i].(*redis.Cmd).Int64()
+		}
+		shard, entry := task.shard, task.entry
+		shard.Lock()
+		if taskErr != nil {
+			entry.counter += entry.pending
+		} else {
+			entry.synced = value
+		}
+		entry.pending = 0
+		entry.syncing = false
+		//同步期间新增的计数或同步失败的计数在下个同步间隔再同步
+		if entry.counter > 0 && shard.get(task.key, now) == entry {
+			shard.scheduleSync(task.conf, task.key, entry, entry.nextSyncAt(task.conf.getSyncInterval(), now))
+		}
+		shard.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHybridEval(t *testing.T) {
+	conf := getDefaultConf()
+	conf.Policy = policyHybrid
+	conf.QPS = 0
+	conf.Minute = 100
+	conf.MaxDrift = 2
+	conf.SyncIntervalMillisecond = int(time.Hour / time.Millisecond)
+	now := time.Now()
+	identifier := "hybrid-" + strconv.FormatInt(now.UnixNano(), 10)
+	windows := conf.getLimitWindows(now)
+	_, keys, args := conf.getAlgorithmScript(identifier, windows, now)
+	//模拟两个kong节点
+	nodeA := newLocalLimitStore(1)
+	nodeB := newLocalLimitStore(1)
+	list := []struct {
+		node     *localLimitStore
+		expected int64
+		wait     bool
+	}{
+		{nodeA, 0, false},
+		//达到MaxDrift，异步同步后redis中为2
+		{nodeA, 1, true},
+		{nodeB, 0, false},
+		//同步后redis中为4
+		{nodeB, 1, true},
+		{nodeB, 4, false},
+		{nodeA, 2, false},
+	}
+	for i, val := range list {
+		reply, err := val.node.hybridEval(*conf, identifier, keys, args, now)
+		if err != nil {
+			t.Fatalf("hybridEval request %d failed, %s", i, err.Error())
+		}
+		if usage := reply.([]interface{})[0].(int64); usage != val.expected {
+			t.Errorf("hybridEval request %d return: [%d], expected: [%d]", i, usage, val.expected)
+		}
+		if val.wait && !waitHybridSync(val.node, identifier, keys[0], now) {
+			t.Fatalf("hybridEval request %d did not sync", i)
+		}
+	}
+	global, err := conf.getRedisClient().Get(ctx, keys[0]).Int64()
+	if err != nil || global != 4 {
+		t.Errorf("redis count return: [%v %v], expected: [%v]", global, err, 4)
+	}
+	//定期同步，后台协程到达同步时间(同步间隔内过期的key在过期前)时调用flushDue
+	nodeA.flushDue(now.Add(time.Duration(argInt64(args[0]))*time.Second - hybridSyncLead))
+	later := now.Add(time.Millisecond)
+	reply, _ := nodeA.hybridEval(*conf, identifier, keys, args, later)
+	if usage := reply.([]interface{})[0].(int64); usage != 5 {
+		t.Errorf("hybridEval after sync return: [%d], expected: [%d]", usage, 5)
+	}
+}
+
+//等待异步同步完成
+func waitHybridSync(store *localLimitStore, identifier string, key string, now time.Time) bool {
+	shard := store.getShard(identifier)
+	for i := 0; i < 200; i++ {
+		shard.Lock()
+		entry := shard.getOrCreate(key, now)
+		synced := entry.counter == 0 && !entry.syncing
+		shard.Unlock()
+		if synced {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestHybridScheduledSync(t *testing.T) {
+	conf := getDefaultConf()
+	conf.Policy = policyHybrid
+	conf.QPS = 0
+	conf.Minute = 100
+	conf.SyncIntervalMillisecond = 20
+	now := time.Now()
+	identifier := "hybrid-scheduled-" + strconv.FormatInt(now.UnixNano(), 10)
+	windows := conf.getLimitWindows(now)
+	_, keys, args := conf.getAlgorithmScript(identifier, windows, now)
+	store := newLocalLimitStore(1)
+	for i := 0; i < 2; i++ {
+		if _, err := store.hybridEval(*conf, identifier, keys, args, now); err != nil {
+			t.Fatalf("hybridEval failed, %s", err.Error())
+		}
+	}
+	//之后没有请求，计数也会在同步间隔后同步到redis
+	if !waitHybridSync(store, identifier, keys[0], now) {
+		t.Fatalf("hybridEval did not sync without later requests")
+	}
+	if global, err := conf.getRedisClient().Get(ctx, keys[0]).Int64(); err != nil || global != 2 {
+		t.Errorf("redis count return: [%v %v], expected: [%v]", global, err, 2)
+	}
+}
+
+func TestHybridSyncSecondWindow(t *testing.T) {
+	conf := getDefaultConf()
+	conf.Policy = policyHybrid
+	now := time.Now()
+	identifier := "hybrid-second-" + strconv.FormatInt(now.UnixNano(), 10)
+	windows := conf.getLimitWindows(now)
+	_, keys, args := conf.getAlgorithmScript(identifier, windows, now)
+	store := newLocalLimitStore(1)
+	for i := 0; i < 2; i++ {
+		if _, err := store.hybridEval(*conf, identifier, keys, args, now); err != nil {
+			t.Fatalf("hybridEval failed, %s", err.Error())
+		}
+	}
+	//只配置QPS时，秒窗口的key在默认同步间隔内过期，需要在过期前同步到redis
+	if !waitHybridSync(store, identifier, keys[0], now) {
+		t.Fatalf("hybridEval with qps only did not sync before the key expired")
+	}
+	if global, err := conf.getRedisClient().Get(ctx, keys[0]).Int64(); err != nil || global != 2 {
+		t.Errorf("redis count return: [%v %v], expected: [%v]", global, err, 2)
+	}
+}
+
+func TestHybridEvalWhileSyncing(t *testing.T) {
+	conf := getDefaultConf()
+	conf.Policy = policyHybrid
+	conf.MaxDrift = 1
+	now := time.Now()
+	identifier := "hybrid-syncing-" + strconv.FormatInt(now.UnixNano(), 10)
+	windows := conf.getLimitWindows(now)
+	_, keys, args := conf.getAlgorithmScript(identifier, windows, now)
+	store := newLocalLimitStore(1)
+	shard := store.getShard(identifier)
+	shard.Lock()
+	shard.getOrCreate(keys[0], now).syncing = true
+	shard.Unlock()
+	//同步中达到MaxDrift时不再发起同步，计数保留在本地
+	for i := 0; i < 3; i++ {
+		if _, err := store.hybridEval(*conf, identifier, keys, args, now); err != nil {
+			t.Fatalf("hybridEval failed, %s", err.Error())
+		}
+	}
+	shard.Lock()
+	defer shard.Unlock()
+	if entry := shard.get(keys[0], now); entry.counter != 3 || entry.pending != 0 {
+		t.Errorf("hybridEval while syncing return: [%d %d], expected: [%d %d]", entry.counter, entry.pending, 3, 0)
+	}
+}
+
+func TestHybridSyncExpired(t *testing.T) {
+	conf := getDefaultConf()
+	conf.Policy = policyHybrid
+	now := time.Now()
+	identifier := "hybrid-expired-" + strconv.FormatInt(now.UnixNano(), 10)
+	windows := conf.getLimitWindows(now)
+	_, keys, args := conf.getAlgorithmScript(identifier, windows, now)
+	store := newLocalLimitStore(1)
+	if _, err := store.hybridEval(*conf, identifier, keys, args, now); err != nil {
+		t.Fatalf("hybridEval failed, %s", err.Error())
+	}
+	//key过期被清理后同步不会重新创建key
+	later := now.Add(time.Hour)
+	shard := store.getShard(identifier)
+	shard.Lock()
+	shard.get(keys[0], later)
+	shard.Unlock()
+	store.flushDue(later)
+	shard.Lock()
+	defer shard.Unlock()
+	if len(shard.entries) != 0 {
+		t.Errorf("sync with expired key return %d entries, expected: %d", len(shard.entries), 0)
+	}
+	if exists, _ := conf.getRedisClient().Exists(ctx, keys[0]).Result(); exists != 0 {
+		t.Errorf("sync with expired key write redis, expected not")
+	}
+}
+
+func TestHybridSyncBatch(t *testing.T) {
+	conf := getDefaultConf()
+	conf.Policy = policyHybrid
+	conf.QPS = 0
+	conf.Minute = 100
+	conf.SyncIntervalMillisecond = int(time.Hour / time.Millisecond)
+	now := time.Now()
+	windows := conf.getLimitWindows(now)
+	store := newLocalLimitStore(localShardCount)
+	count := hybridSyncBatchSize + 10
+	var syncAt time.Time
+	for i := 0; i < count; i++ {
+		identifier := "hybrid-batch-" + strconv.Itoa(i)
+		_, keys, args := conf.getAlgorithmScript(identifier, windows, now)
+		if _, err := store.hybridEval(*conf, identifier, keys, args, now); err != nil {
+			t.Fatalf("hybridEval failed, %s", err.Error())
+		}
+		//同步间隔内过期的key在过期前同步
+		syncAt = now.Add(time.Duration(argInt64(args[0]))*time.Second - hybridSyncLead)
+	}
+	//没有到达同步时间的key不同步
+	if tasks := store.takeDueSyncs(now); len(tasks) != 0 {
+		t.Errorf("takeDueSyncs before sync time return %d tasks, expected: %d", len(tasks), 0)
+	}
+	//所有标识的key在一次检查中取出，同一个redis按批次通过pipeline同步，而不是每个标识一次
+	tasks := store.takeDueSyncs(syncAt)
+	if len(tasks) != count {
+		t.Fatalf("takeDueSyncs return %d tasks, expected: %d", len(tasks), count)
+	}
+	batches := groupSyncTasks(tasks)
+	if len(batches) != 2 || len(batches[0]) != hybridSyncBatchSize || len(batches[1]) != 10 {
+		t.Errorf("groupSyncTasks return %d batches, expected: %d batches of %d and %d", len(batches), 2, hybridSyncBatchSize, 10)
+	}
+	//同步中的key不会重复取出
+	if tasks := store.takeDueSyncs(syncAt); len(tasks) != 0 {
+		t.Errorf("takeDueSyncs while syncing return %d tasks, expected: %d", len(tasks), 0)
+	}
+	//不同redis的key分别同步
+	other := *tasks[0].conf
+	other.RedisDB = 1
+	tasks[0].conf = &other
+	if batches := groupSyncTasks(tasks); len(batches) != 3 {
+		t.Errorf("groupSyncTasks with two redis return %d batches, expected: %d", len(batches), 3)
+	}
+}
+
+func TestCheckConfigWithHybridPolicy(t *testing.T) {
+	conf := getDefaultConf()
+	conf.Policy = policyHybrid
+	if err := conf.checkConfig(); err != nil {
+		t.Errorf("checkConfig with hybrid policy failed, %s", err.Error())
+	}
+	conf.Algorithm = algorithmGCRA
+	expected := "hybrid policy is not supported by gcra algorithm"
+	if err := conf.checkConfig(); err == nil || err.Error() != expected {
+		t.Errorf("checkConfig return: [%v], expected: [%s]", err, expected)
+	}
+}
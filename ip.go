@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Kong/go-pdk"
+	"net"
+	"strings"
+)
+
+//解析后的可信代理缓存，key为TrustedProxies配置
+var trustedProxyCache = newBoundedCache(configCacheSize)
+
+//获取客户端ip，配置了TrustedProxies时只信任来自这些代理的X-Forwarded-For，否则使用kong的trusted_ips配置
+func (conf Config) getClientIp(kong *pdk.PDK) (string, error) {
+	if conf.TrustedProxies == "" {
+		return kong.Client.GetForwardedIp()
+	}
+	ip, err := kong.Client.GetIp()
+	if err != nil {
+		return "", err
+	}
+	proxies, err := conf.getTrustedProxies()
+	if err != nil {
+		return "", err
+	}
+	//直接连接的不是可信代理，X-Forwarded-For可能是伪造的
+	if !inNetworks(ip, proxies) {
+		return ip, nil
+	}
+	forwardedFor, err := kong.Request.GetHeader("X-Forwarded-For")
+	if err != nil || forwardedFor == "" {
+		return ip, nil
+	}
+	return getForwardedClientIp(ip, forwardedFor, proxies), nil
+}
+
+//获取解析后的可信代理列表，配置没有变化时使用缓存
+func (conf Config) getTrustedProxies() ([]*net.IPNet, error) {
+	if conf.TrustedProxies == "" {
+		return nil, nil
+	}
+	if cached, ok := trustedProxyCache.Load(conf.TrustedProxies); ok {
+		return cached.([]*net.IPNet), nil
+	}
+	var proxies []*net.IPNet
+	for _, item := range strings.Split(conf.TrustedProxies, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		network, err := parseNetwork(item)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("TrustedProxies with invalid ip or cidr %s", item))
+		}
+		proxies = append(proxies, network)
+	}
+	trustedProxyCache.Store(conf.TrustedProxies, proxies)
+	return proxies, nil
+}
+
+//从右向左遍历X-Forwarded-For，跳过可信代理，第一个不可信的ip即为客户端ip
+func getForwardedClientIp(remoteIp string, forwardedFor string, proxies []*net.IPNet) string {
+	clientIp := remoteIp
+	ips := strings.Split(forwardedFor, ",")
+	for i := len(ips) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(ips[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		clientIp = ip
+		if !inNetworks(ip, proxies) {
+			break
+		}
+	}
+	return clientIp
+}
+
+//解析ip或网段，单个ip转换为/32或/128的网段
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, errors.New("invalid ip " + value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+//ip是否在网段列表中
+func inNetworks(value string, networks []*net.IPNet) bool {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//规则类型包含ip时，将限流值解析为ip及网段
+func (resource *limitResource) compileNetworks() error {
+	resource.networks = nil
+	hasIpType := false
+	for _, limitType := range strings.Split(resource.Type, ",") {
+		if strings.ToLower(limitType) == "ip" {
+			hasIpType = true
+		}
+	}
+	if !hasIpType {
+		return nil
+	}
+	for _, pattern := range resource.patterns {
+		network, err := parseNetwork(pattern)
+		if err != nil {
+			return errors.New(fmt.Sprintf("LimitResourcesJson with invalid ip or cidr %s", pattern))
+		}
+		resource.networks = append(resource.networks, network)
+	}
+	return nil
+}
+
+//客户端ip是否在规则的ip或网段中，使用匹配到的ip或网段作为限流key
+func (resource limitResource) matchIp(find string) (limitKey string, pattern string, matched bool) {
+	if resource.networks == nil {
+		return resource.matchValue(find)
+	}
+	ip := net.ParseIP(find)
+	if ip == nil {
+		return "", "", false
+	}
+	for i, network := range resource.networks {
+		if network.Contains(ip) {
+			return resource.patterns[i], resource.patterns[i], true
+		}
+	}
+	//*或空值匹配任意ip，按每个ip分别限流
+	if resource.anyValue {
+		return find, "*", true
+	}
+	return "", "", false
+}
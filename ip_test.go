@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetwork(t *testing.T) {
+	list := []struct {
+		value    string
+		expected string
+	}{
+		{"10.0.0.1", "10.0.0.1/32"},
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"10.0.0", ""},
+		{"10.0.0.0/33", ""},
+	}
+	for _, val := range list {
+		network, err := parseNetwork(val.value)
+		if val.expected == "" {
+			if err == nil {
+				t.Errorf("parseNetwork [%s] success, expected error", val.value)
+			}
+			continue
+		}
+		if err != nil || network.String() != val.expected {
+			t.Errorf("parseNetwork [%s] return: [%v %v], expected: [%s]", val.value, network, err, val.expected)
+		}
+	}
+}
+
+func TestGetForwardedClientIp(t *testing.T) {
+	proxies := []*net.IPNet{}
+	for _, item := range []string{"10.0.0.0/8", "192.168.1.1"} {
+		network, _ := parseNetwork(item)
+		proxies = append(proxies, network)
+	}
+	list := []struct {
+		remoteIp     string
+		forwardedFor string
+		expected     string
+	}{
+		{"10.0.0.1", "1.1.1.1", "1.1.1.1"},
+		{"10.0.0.1", "1.1.1.1, 192.168.1.1, 10.0.0.2", "1.1.1.1"},
+		//客户端伪造的X-Forwarded-For在最左边，不会被使用
+		{"10.0.0.1", "6.6.6.6, 1.1.1.1, 10.0.0.2", "1.1.1.1"},
+		//全部是可信代理时使用最左边的ip
+		{"10.0.0.1", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		//非法的ip不再继续向左查找
+		{"10.0.0.1", "1.1.1.1, unknown, 10.0.0.2", "10.0.0.2"},
+	}
+	for _, val := range list {
+		actual := getForwardedClientIp(val.remoteIp, val.forwardedFor, proxies)
+		if actual != val.expected {
+			t.Errorf("getForwardedClientIp [%s] return: [%s], expected: [%s]", val.forwardedFor, actual, val.expected)
+		}
+	}
+}
+
+func TestMatchIp(t *testing.T) {
+	list := []struct {
+		value    string
+		find     string
+		limitKey string
+		expected bool
+	}{
+		{"10.0.0.1,192.168.0.0/16", "10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.1,192.168.0.0/16", "192.168.3.4", "192.168.0.0/16", true},
+		{"10.0.0.1,192.168.0.0/16", "10.0.0.2", "", false},
+		{"2001:db8::/32", "2001:db8::abcd", "2001:db8::/32", true},
+		{"2001:db8::/32", "2001:db9::1", "", false},
+		{"10.0.0.0/8", "not-an-ip", "", false},
+		//匹配任意ip时按每个ip分别限流
+		{"*", "1.2.3.4", "1.2.3.4", true},
+	}
+	for _, val := range list {
+		resource := limitResource{Type: "ip", Key: "ip", Value: val.value}
+		if err := resource.compile(); err != nil {
+			t.Fatalf("compile [%s] failed, %s", val.value, err.Error())
+		}
+		limitKey, _, matched := resource.matchIp(val.find)
+		if limitKey != val.limitKey || matched != val.expected {
+			t.Errorf("matchIp [%s] in [%s] return: [%s %v], expected: [%s %v]", val.find, val.value, limitKey, matched, val.limitKey, val.expected)
+		}
+	}
+	resource := limitResource{Type: "ip", Key: "ip", Value: "10.0.0.1,10.0.0"}
+	if err := resource.compile(); err == nil || err.Error() != "LimitResourcesJson with invalid ip or cidr 10.0.0" {
+		t.Errorf("compile return: [%v], expected: [%s]", err, "LimitResourcesJson with invalid ip or cidr 10.0.0")
+	}
+}
+
+func TestCheckConfigWithTrustedProxies(t *testing.T) {
+	conf := getDefaultConf()
+	conf.TrustedProxies = "10.0.0.0/8, 192.168.1.1,2001:db8::/32"
+	if err := conf.checkConfig(); err != nil {
+		t.Errorf("checkConfig failed, %s", err.Error())
+	}
+	conf.TrustedProxies = "10.0.0.0/8,localhost"
+	if err := conf.checkConfig(); err == nil || err.Error() != "TrustedProxies with invalid ip or cidr localhost" {
+		t.Errorf("checkConfig return: [%v], expected: [%s]", err, "TrustedProxies with invalid ip or cidr localhost")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Kong/go-pdk"
+	"math/big"
+	"strings"
+	"time"
+)
+
+//解析后的jwt公钥缓存，key为JwtPublicKeys配置
+var jwtPublicKeyCache = newBoundedCache(configCacheSize)
+
+//jwt头部
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+//获取Authorization header中bearer jwt的claim，key为claim路径，如tenant_id、org.id
+func (conf Config) getJwtClaimValues(kong *pdk.PDK, key string) ([]string, error) {
+	authorization, err := kong.Request.GetHeader("Authorization")
+	if err != nil {
+		return nil, err
+	}
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "bearer ") {
+		return nil, nil
+	}
+	payload, err := conf.parseJwt(strings.TrimSpace(authorization[7:]), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return getJsonValues(payload, key)
+}
+
+//解析jwt并返回payload，配置了JwtSecret或JwtPublicKeys时校验签名及exp、nbf
+func (conf Config) parseJwt(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("invalid jwt")
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.New("invalid jwt header")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("invalid jwt payload")
+	}
+	if conf.JwtSecret == "" && conf.JwtPublicKeys == "" {
+		return string(payload), nil
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return "", errors.New("invalid jwt header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("invalid jwt signature")
+	}
+	if err := conf.verifyJwtSignature(header.Alg, parts[0]+"."+parts[1], signature); err != nil {
+		return "", err
+	}
+	var claims struct {
+		Exp *float64 `json:"exp"`
+		Nbf *float64 `json:"nbf"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", errors.New("invalid jwt payload")
+	}
+	if claims.Exp != nil && float64(now.Unix()) >= *claims.Exp {
+		return "", errors.New("jwt expired")
+	}
+	if claims.Nbf != nil && float64(now.Unix()) < *claims.Nbf {
+		return "", errors.New("jwt not valid yet")
+	}
+	return string(payload), nil
+}
+
+//校验签名，支持HS256/384/512、RS256/384/512、ES256/384/512，公钥可配置多个，任意一个校验通过即可
+func (conf Config) verifyJwtSignature(alg string, signingInput string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "HS256", "RS256", "ES256":
+		hash = crypto.SHA256
+	case "HS384", "RS384", "ES384":
+		hash = crypto.SHA384
+	case "HS512", "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return errors.New(fmt.Sprintf("unsupported jwt alg %s", alg))
+	}
+	if strings.HasPrefix(alg, "HS") {
+		if conf.JwtSecret == "" {
+			return errors.New("jwt secret not configured")
+		}
+		mac := hmac.New(hash.New, []byte(conf.JwtSecret))
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid jwt signature")
+		}
+		return nil
+	}
+	keys, err := conf.getJwtPublicKeys()
+	if err != nil {
+		return err
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(signingInput))
+	digest := hasher.Sum(nil)
+	for _, key := range keys {
+		switch publicKey := key.(type) {
+		case *rsa.PublicKey:
+			if strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(publicKey, hash, digest, signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			//ES签名为r和s拼接，长度相等
+			if strings.HasPrefix(alg, "ES") && len(signature)%2 == 0 {
+				r := new(big.Int).SetBytes(signature[:len(signature)/2])
+				s := new(big.Int).SetBytes(signature[len(signature)/2:])
+				if ecdsa.Verify(publicKey, digest, r, s) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("invalid jwt signature")
+}
+
+//获取解析后的jwt公钥，配置没有变化时使用缓存
+func (conf Config) getJwtPublicKeys() ([]interface{}, error) {
+	if conf.JwtPublicKeys == "" {
+		return nil, nil
+	}
+	if cached, ok := jwtPublicKeyCache.Load(conf.JwtPublicKeys); ok {
+		return cached.([]interface{}), nil
+	}
+	var keys []interface{}
+	rest := []byte(conf.JwtPublicKeys)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			//兼容PKCS1格式的RSA公钥
+			if key, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+				return nil, errors.New("JwtPublicKeys with invalid public key")
+			}
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 || strings.TrimSpace(string(rest)) != "" {
+		return nil, errors.New("JwtPublicKeys with invalid public key")
+	}
+	jwtPublicKeyCache.Store(conf.JwtPublicKeys, keys)
+	return keys, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//生成测试用的jwt
+func signJwt(t *testing.T, alg string, payload string, key interface{}) string {
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"`+alg+`","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+	hasher := crypto.SHA256.New()
+	hasher.Write([]byte(signingInput))
+	digest := hasher.Sum(nil)
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(crypto.SHA256.New, key)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//r、s各32字节，不足时左侧补0
+		signature = make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+//将公钥转换为PEM格式
+func encodePublicKey(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestParseJwt(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	secret := []byte("secret")
+	now := time.Unix(1600067356, 0)
+	payload := `{"tenant_id": "tenant-a", "org": {"id": 42}, "exp": 1600067400}`
+	list := []struct {
+		name          string
+		token         string
+		secret        string
+		publicKeys    string
+		expectedError bool
+	}{
+		{"decode only", signJwt(t, "HS256", payload, []byte("other")), "", "", false},
+		{"hs256", signJwt(t, "HS256", payload, secret), "secret", "", false},
+		{"hs256 wrong secret", signJwt(t, "HS256", payload, []byte("other")), "secret", "", true},
+		{"rs256", signJwt(t, "RS256", payload, rsaKey), "", encodePublicKey(t, &rsaKey.PublicKey), false},
+		//多个公钥时任意一个校验通过即可
+		{"es256", signJwt(t, "ES256", payload, ecKey), "", encodePublicKey(t, &otherKey.PublicKey) + encodePublicKey(t, &ecKey.PublicKey), false},
+		{"es256 wrong key", signJwt(t, "ES256", payload, ecKey), "", encodePublicKey(t, &otherKey.PublicKey), true},
+		{"rs256 without public key", signJwt(t, "RS256", payload, rsaKey), "secret", "", true},
+		{"none alg", signJwt(t, "none", payload, nil), "secret", "", true},
+		{"expired", signJwt(t, "HS256", `{"tenant_id": "tenant-a", "exp": 1600067356}`, secret), "secret", "", true},
+		{"not before", signJwt(t, "HS256", `{"tenant_id": "tenant-a", "nbf": 1600067357}`, secret), "secret", "", true},
+		{"invalid", "abc.def", "", "", true},
+	}
+	for _, val := range list {
+		conf := getDefaultConf()
+		conf.JwtSecret = val.secret
+		conf.JwtPublicKeys = val.publicKeys
+		actual, err := conf.parseJwt(val.token, now)
+		if val.expectedError {
+			if err == nil {
+				t.Errorf("parseJwt [%s] success, expected error", val.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseJwt [%s] failed, %s", val.name, err.Error())
+			continue
+		}
+		findList, _ := getJsonValues(actual, "org.id")
+		if !reflect.DeepEqual(findList, []string{"42"}) {
+			t.Errorf("parseJwt [%s] claim return: [%v], expected: [%v]", val.name, findList, []string{"42"})
+		}
+	}
+}
+
+func TestGetRequestValuesWithJwtClaim(t *testing.T) {
+	token := signJwt(t, "HS256", `{"tenant_id": "tenant-a"}`, []byte("secret"))
+	conf := getDefaultConf()
+	conf.JwtSecret = "secret"
+	list := []struct {
+		authorization string
+		expected      []string
+	}{
+		{"Bearer " + token, []string{"tenant-a"}},
+		{"bearer  " + token, []string{"tenant-a"}},
+		{"Basic dXNlcjpwYXNz", nil},
+		{"", nil},
+	}
+	for _, val := range list {
+		kong := newMockPdk(map[string]interface{}{
+			"kong.request.get_header": val.authorization,
+		})
+		findList, err := conf.getRequestValues(kong, "jwt_claim", "tenant_id")
+		if err != nil || !reflect.DeepEqual(findList, val.expected) {
+			t.Errorf("getRequestValues [jwt_claim] [%s] return: [%v %v], expected: [%v]", val.authorization, findList, err, val.expected)
+		}
+	}
+}
+
+func TestCheckConfigWithJwtPublicKeys(t *testing.T) {
+	conf := getDefaultConf()
+	conf.JwtPublicKeys = "-----BEGIN PUBLIC KEY-----\nYWJj\n-----END PUBLIC KEY-----\n"
+	if err := conf.checkConfig(); err == nil || err.Error() != "JwtPublicKeys with invalid public key" {
+		t.Errorf("checkConfig return: [%v], expected: [%s]", err, "JwtPublicKeys with invalid public key")
+	}
+	conf.JwtPublicKeys = "not a pem"
+	if err := conf.checkConfig(); err == nil || err.Error() != "JwtPublicKeys with invalid public key" {
+		t.Errorf("checkConfig return: [%v], expected: [%s]", err, "JwtPublicKeys with invalid public key")
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//限流策略:本地内存，计数保存在插件进程中，不依赖redis，多个kong节点各自计数
+const policyLocal = "local"
+
+//本地计数的分片数，减少锁竞争
+const localShardCount = 64
+
+//本地计数清理过期key的间隔
+const localSweepInterval = time.Minute
+
+//进程内的本地计数
+var localStore = newLocalLimitStore(localShardCount)
+
+//本地计数，按标识分片，每个分片一把锁，同一标识的所有key在同一分片中，保证与lua脚本一样的原子性
+type localLimitStore struct {
+	shards []*localShard
+
+	syncOnce sync.Once     //混合策略:只启动一个后台同步协程
+	syncWake chan struct{} //混合策略:唤醒后台同步协程
+}
+
+//本地计数分片
+type localShard struct {
+	sync.Mutex
+	entries   map[string]*localEntry
+	nextSweep time.Time       //下次清理过期key的时间
+	syncQueue hybridSyncQueue //混合策略:等待同步的key
+}
+
+//本地计数的值，与redis中的结构对应
+type localEntry struct {
+	counter  int64     //计数器，gcra为理论到达时间
+	values   []int64   //滑动窗口日志为请求时间戳(从小到大)，令牌桶为{令牌数, 上次补充时间}
+	expireAt time.Time //过期时间，为空表示不过期
+
+	synced   int64     //混合策略:上次同步时redis中的全局计数
+	pending  int64     //混合策略:正在同步到redis的计数
+	syncing  bool      //混合策略:是否正在同步
+	syncAt   time.Time //混合策略:计划同步的时间，为空表示没有安排同步
+	syncConf *Config   //混合策略:同步使用的配置
+}
+
+//创建本地计数
+func newLocalLimitStore(shardCount int) *localLimitStore {
+	store := &localLimitStore{}
+	for i := 0; i < shardCount; i++ {
+		store.shards = append(store.shards, &localShard{entries: map[string]*localEntry{}})
+	}
+	return store
+}
+
+//执行与lua脚本相同的逻辑，返回值与redis eval的返回值格式相同
+func (store *localLimitStore) eval(algorithm string, identifier string, keys []string, args []interface{}, now time.Time) (interface{}, error) {
+	shard := store.getShard(identifier)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.sweep(now)
+	switch algorithm {
+	case algorithmSlidingWindowCounter:
+		return shard.slidingWindowCounter(keys, args, now), nil
+	case algorithmSlidingWindowLog:
+		return shard.slidingWindowLog(keys, args, now), nil
+	case algorithmTokenBucket:
+		return shard.tokenBucket(keys, args, now), nil
+	case algorithmGCRA:
+		return shard.gcra(keys, args, now), nil
+	case "", algorithmFixedWindow:
+		return shard.fixedWindow(keys, args, now), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported algorithm %s", algorithm))
+	}
+}
+
+//获取标识所在的分片
+func (store *localLimitStore) getShard(identifier string) *localShard {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(identifier))
+	return store.shards[hash.Sum32()%uint32(len(store.shards))]
+}
+
+//清理分片中过期的key
+func (shard *localShard) sweep(now time.Time) {
+	if now.Before(shard.nextSweep) {
+		return
+	}
+	for key, entry := range shard.entries {
+		if entry.expired(now) {
+			delete(shard.entries, key)
+		}
+	}
+	shard.nextSweep = now.Add(localSweepInterval)
+}
+
+//获取未过期的值，不存在时返回nil
+func (shard *localShard) get(key string, now time.Time) *localEntry {
+	entry, ok := shard.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.expired(now) {
+		delete(shard.entries, key)
+		return nil
+	}
+	return entry
+}
+
+//获取未过期的值，不存在时创建
+func (shard *localShard) getOrCreate(key string, now time.Time) *localEntry {
+	entry := shard.get(key, now)
+	if entry == nil {
+		entry = &localEntry{}
+		shard.entries[key] = entry
+	}
+	return entry
+}
+
+//是否已过期
+func (entry *localEntry) expired(now time.Time) bool {
+	return !entry.expireAt.IsZero() && !now.Before(entry.expireAt)
+}
+
+//固定窗口，对应fixedWindowScript
+func (shard *localShard) fixedWindow(keys []string, args []interface{}, now time.Time) []interface{} {
+	usages := make([]interface{}, len(keys))
+	for i, key := range keys {
+		entry := shard.getOrCreate(key, now)
+		entry.counter++
+		if entry.counter == 1 {
+			entry.expireAt = now.Add(time.Duration(argInt64(args[i])) * time.Second)
+		}
+		usages[i] = entry.counter - 1
+	}
+	return usages
+}
+
+//滑动窗口计数，对应slidingWindowCounterScript
+func (shard *localShard) slidingWindowCounter(keys []string, args []interface{}, now time.Time) []interface{} {
+	estimates := make([]interface{}, len(keys)/2)
+	exceeded := false
+	for i := range estimates {
+		var current, previous int64
+		if entry := shard.get(keys[2*i], now); entry != nil {
+			current = entry.counter
+		}
+		if entry := shard.get(keys[2*i+1], now); entry != nil {
+			previous = entry.counter
+		}
+		estimate := int64(math.Floor(float64(previous)*argFloat64(args[3*i+1]))) + current
+		if estimate >= argInt64(args[3*i]) {
+			exceeded = true
+		}
+		estimates[i] = estimate
+	}
+	if !exceeded {
+		for i := range estimates {
+			entry := shard.getOrCreate(keys[2*i], now)
+			entry.counter++
+			if entry.counter == 1 {
+				entry.expireAt = now.Add(time.Duration(argInt64(args[3*i+2])) * time.Second)
+			}
+		}
+	}
+	return estimates
+}
+
+//滑动窗口日志，对应slidingWindowLogScript
+func (shard *localShard) slidingWindowLog(keys []string, args []interface{}, now time.Time) []interface{} {
+	entry := shard.getOrCreate(keys[0], now)
+	nowMs := argInt64(args[0])
+	var maxWindow int64
+	for i := 2; i+1 < len(args); i += 2 {
+		if window := argInt64(args[i+1]); window > maxWindow {
+			maxWindow = window
+		}
+	}
+	//清理最大窗口外的请求记录
+	start := sort.Search(len(entry.values), func(i int) bool { return entry.values[i] > nowMs-maxWindow })
+	entry.values = entry.values[start:]
+	var result []interface{}
+	exceeded := false
+	for i := 2; i+1 < len(args); i += 2 {
+		min := nowMs - argInt64(args[i+1])
+		index := sort.Search(len(entry.values), func(i int) bool { return entry.values[i] > min })
+		count := int64(len(entry.values) - index)
+		oldest := nowMs
+		if count > 0 {
+			oldest = entry.values[index]
+		}
+		if count >= argInt64(args[i]) {
+			exceeded = true
+		}
+		result = append(result, count, oldest)
+	}
+	if !exceeded {
+		index := sort.Search(len(entry.values), func(i int) bool { return entry.values[i] > nowMs })
+		entry.values = append(entry.values, 0)
+		copy(entry.values[index+1:], entry.values[index:])
+		entry.values[index] = nowMs
+	}
+	entry.expireAt = now.Add(time.Duration(maxWindow) * time.Millisecond)
+	return result
+}
+
+//令牌桶，对应tokenBucketScript
+func (shard *localShard) tokenBucket(keys []string, args []interface{}, now time.Time) []interface{} {
+	rate, burst, interval, nowMs := argInt64(args[0]), argInt64(args[1]), argInt64(args[2]), argInt64(args[3])
+	entry := shard.getOrCreate(keys[0], now)
+	if len(entry.values) != 2 {
+		entry.values = []int64{burst, nowMs}
+	}
+	tokens, ts := entry.values[0], entry.values[1]
+	if periods := int64(math.Floor(float64(nowMs-ts) / float64(interval))); periods > 0 {
+		tokens = minInt64(burst, tokens+periods*rate)
+		ts = ts + periods*interval
+	}
+	var allowed int64
+	if tokens > 0 {
+		tokens--
+		allowed = 1
+	}
+	entry.values = []int64{tokens, ts}
+	entry.expireAt = now.Add(time.Duration(int64(math.Ceil(float64(burst)/float64(rate)))*interval+interval) * time.Millisecond)
+	wait := ts + interval - nowMs
+	if wait < 0 {
+		wait = 0
+	}
+	return []interface{}{allowed, tokens, wait}
+}
+
+//GCRA，对应gcraScript
+func (shard *localShard) gcra(keys []string, args []interface{}, now time.Time) []interface{} {
+	emission, burst, nowUs := argInt64(args[0]), argInt64(args[1]), argInt64(args[2])
+	tat := nowUs
+	if entry := shard.get(keys[0], now); entry != nil && entry.counter > nowUs {
+		tat = entry.counter
+	}
+	newTat := tat + emission
+	allowAt := newTat - burst*emission
+	if nowUs < allowAt {
+		return []interface{}{int64(0), int64(0), allowAt - nowUs}
+	}
+	entry := shard.getOrCreate(keys[0], now)
+	entry.counter = newTat
+	entry.expireAt = now.Add(time.Duration(int64(math.Ceil(float64(newTat-nowUs)/1000))) * time.Millisecond)
+	return []interface{}{int64(1), (nowUs - allowAt) / emission, newTat - nowUs}
+}
+
+//将lua脚本的参数转换为int64
+func argInt64(arg interface{}) int64 {
+	return int64(argFloat64(arg))
+}
+
+//将lua脚本的参数转换为float64
+func argFloat64(arg interface{}) float64 {
+	value, _ := strconv.ParseFloat(fmt.Sprint(arg), 64)
+	return value
+}
+
+//取较小的值
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/Kong/go-pdk"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckConfigWithLocalPolicy(t *testing.T) {
+	conf := &Config{QPS: 10, Policy: policyLocal}
+	if err := conf.checkConfig(); err != nil {
+		t.Errorf("checkConfig with local policy failed, %s", err.Error())
+	}
+	conf.Policy = ""
+	expected := "Key: 'Config.RedisHost' Error:Field validation for 'RedisHost' failed on the 'required' tag"
+	if err := conf.checkConfig(); err == nil || !strings.HasPrefix(err.Error(), expected) {
+		t.Errorf("checkConfig return: [%v], expected: [%s]", err, expected)
+	}
+}
+
+func TestGetRemainingAndIncrWithLocalPolicy(t *testing.T) {
+	kong := &pdk.PDK{}
+	now := time.Now()
+	for _, algorithm := range []string{algorithmFixedWindow, algorithmSlidingWindowCounter, algorithmSlidingWindowLog, algorithmTokenBucket, algorithmGCRA} {
+		//不需要redis
+		conf := &Config{QPS: 3, Algorithm: algorithm, Policy: policyLocal}
+		identifier := "local-" + strconv.FormatInt(now.UnixNano(), 10)
+		expected := []struct {
+			remaining int
+			stop      bool
+		}{
+			{2, false},
+			{1, false},
+			{0, false},
+			{0, true},
+		}
+		for i, val := range expected {
+			result, err := conf.getRemainingAndIncr(kong, identifier, now)
+			if err != nil {
+				t.Fatalf("getRemainingAndIncr with local policy and algorithm [%s] failed, %s", algorithm, err.Error())
+			}
+			if result.remaining != val.remaining || result.stop != val.stop {
+				t.Errorf("getRemainingAndIncr with local policy and algorithm [%s] request %d return: [%v %v], expected: [%v %v]", algorithm, i, result.remaining, result.stop, val.remaining, val.stop)
+			}
+		}
+	}
+}
+
+//本地策略与redis策略的结果应该完全相同
+func TestLocalPolicyConsistentWithRedis(t *testing.T) {
+	kong := &pdk.PDK{}
+	now := time.Now()
+	offsets := []time.Duration{0, 0, 100 * time.Millisecond, 300 * time.Millisecond, 700 * time.Millisecond, time.Second, 1100 * time.Millisecond, 1500 * time.Millisecond, 3 * time.Second, 3 * time.Second, 62 * time.Second}
+	for _, algorithm := range []string{algorithmFixedWindow, algorithmSlidingWindowCounter, algorithmSlidingWindowLog, algorithmTokenBucket, algorithmGCRA} {
+		conf := getDefaultConf()
+		conf.QPS = 2
+		conf.Algorithm = algorithm
+		if algorithm != algorithmTokenBucket && algorithm != algorithmGCRA {
+			conf.Minute = 6
+		}
+		local := *conf
+		local.Policy = policyLocal
+		identifier := "local-" + algorithm + "-" + strconv.FormatInt(now.UnixNano(), 10)
+		for i, offset := range offsets {
+			expected, err := conf.getRemainingAndIncr(kong, identifier, now.Add(offset))
+			if err != nil {
+				t.Fatalf("getRemainingAndIncr with algorithm [%s] failed, %s", algorithm, err.Error())
+			}
+			actual, err := local.getRemainingAndIncr(kong, identifier, now.Add(offset))
+			if err != nil {
+				t.Fatalf("getRemainingAndIncr with local policy and algorithm [%s] failed, %s", algorithm, err.Error())
+			}
+			if actual != expected {
+				t.Errorf("getRemainingAndIncr with local policy and algorithm [%s] request %d return: [%+v], expected: [%+v]", algorithm, i, actual, expected)
+			}
+		}
+	}
+}
+
+func TestLocalLimitStoreExpire(t *testing.T) {
+	store := newLocalLimitStore(1)
+	now := time.Now()
+	for i, expected := range []int64{0, 1, 0} {
+		reply, _ := store.eval(algorithmFixedWindow, "expire", []string{"expire:key"}, []interface{}{"1"}, now.Add(time.Duration(i/2)*time.Second))
+		if usage := reply.([]interface{})[0].(int64); usage != expected {
+			t.Errorf("eval request %d return: [%d], expected: [%d]", i, usage, expected)
+		}
+	}
+	//清理过期的key
+	store.eval(algorithmFixedWindow, "other", []string{"other:key"}, []interface{}{"1"}, now.Add(2*localSweepInterval))
+	if _, ok := store.shards[0].entries["expire:key"]; ok || len(store.shards[0].entries) != 1 {
+		t.Errorf("sweep did not remove the expired key, entries: %v", store.shards[0].entries)
+	}
+}
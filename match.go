@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//匹配方式:完全相等(默认)
+const matchExact = "exact"
+
+//匹配方式:前缀
+const matchPrefix = "prefix"
+
+//匹配方式:后缀
+const matchSuffix = "suffix"
+
+//匹配方式:正则，有捕获组时使用第一个捕获组作为限流key
+const matchRegex = "regex"
+
+//匹配方式:通配符，*匹配任意字符串，?匹配任意单个字符
+const matchGlob = "glob"
+
+//解析并编译规则中的匹配模式，只在加载配置时执行一次
+func (resource *limitResource) compile() error {
+	resource.Match = strings.ToLower(resource.Match)
+	resource.patterns = nil
+	resource.anyValue = false
+	if len(resource.Values) > 0 {
+		for pattern := range resource.Values {
+			if pattern == "*" {
+				resource.anyValue = true
+			} else {
+				resource.patterns = append(resource.patterns, pattern)
+			}
+		}
+		//map无序，按长度从长到短排序，前缀等匹配时优先匹配更具体的模式
+		sort.Slice(resource.patterns, func(i, j int) bool {
+			if len(resource.patterns[i]) != len(resource.patterns[j]) {
+				return len(resource.patterns[i]) > len(resource.patterns[j])
+			}
+			return resource.patterns[i] < resource.patterns[j]
+		})
+	} else if resource.Value == "" {
+		resource.anyValue = true
+	} else {
+		//正则和通配符中可能有逗号(如{1,2})，不按逗号分隔，多个模式使用values配置
+		patterns := []string{resource.Value}
+		if resource.Match != matchRegex && resource.Match != matchGlob {
+			patterns = strings.Split(resource.Value, ",")
+		}
+		for _, pattern := range patterns {
+			if pattern == "*" {
+				resource.anyValue = true
+			} else {
+				resource.patterns = append(resource.patterns, pattern)
+			}
+		}
+	}
+	resource.regexps = nil
+	switch resource.Match {
+	case "", matchExact:
+		return resource.compileNetworks()
+	case matchPrefix, matchSuffix:
+		return nil
+	case matchRegex:
+		for _, pattern := range resource.patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return errors.New(fmt.Sprintf("LimitResourcesJson with invalid regex %s,%s", pattern, err.Error()))
+			}
+			resource.regexps = append(resource.regexps, re)
+		}
+		return nil
+	case matchGlob:
+		for _, pattern := range resource.patterns {
+			resource.regexps = append(resource.regexps, regexp.MustCompile(globToRegexp(pattern)))
+		}
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("LimitResourcesJson with unsupported match %s", resource.Match))
+	}
+}
+
+//请求中的值是否匹配规则，返回限流key及匹配到的模式，非exact匹配时使用模式(或正则的捕获组)作为限流key
+func (resource limitResource) matchValue(find string) (limitKey string, pattern string, matched bool) {
+	for i, pattern := range resource.patterns {
+		switch resource.Match {
+		case matchPrefix:
+			if strings.HasPrefix(find, pattern) {
+				return pattern, pattern, true
+			}
+		case matchSuffix:
+			if strings.HasSuffix(find, pattern) {
+				return pattern, pattern, true
+			}
+		case matchRegex, matchGlob:
+			subMatch := resource.regexps[i].FindStringSubmatch(find)
+			if subMatch == nil {
+				continue
+			}
+			//可选的捕获组没有参与匹配时为空，使用模式作为限流key，避免所有请求共用一个空key
+			if len(subMatch) > 1 && subMatch[1] != "" {
+				return subMatch[1], pattern, true
+			}
+			return pattern, pattern, true
+		default:
+			if find == pattern {
+				return find, pattern, true
+			}
+		}
+	}
+	//*或空值匹配其他任意非空值，使用实际的值作为限流key，即按每个不同的值分别限流
+	if resource.anyValue && find != "" {
+		return find, "*", true
+	}
+	return "", "", false
+}
+
+//将通配符转换为正则
+func globToRegexp(glob string) string {
+	quoted := regexp.QuoteMeta(glob)
+	quoted = strings.Replace(quoted, `\*`, `.*`, -1)
+	quoted = strings.Replace(quoted, `\?`, `.`, -1)
+	return "^" + quoted + "$"
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMatchValue(t *testing.T) {
+	list := []struct {
+		resource limitResource
+		find     string
+		limitKey string
+		pattern  string
+		expected bool
+	}{
+		{limitResource{Value: "orderA,orderB"}, "orderA", "orderA", "orderA", true},
+		{limitResource{Value: "orderA,orderB"}, "orderC", "", "", false},
+		{limitResource{Values: map[string]int{"orderA": 5, "orderB": 50}}, "orderB", "orderB", "orderB", true},
+		{limitResource{Values: map[string]int{"orderA": 5, "orderB": 50}}, "orderC", "", "", false},
+		{limitResource{Values: map[string]int{"orderA": 5, "*": 10}}, "orderC", "orderC", "*", true},
+		{limitResource{Values: map[string]int{"orderA": 5, "*": 10}}, "", "", "", false},
+		{limitResource{Value: "/api/orders,/api/users", Match: matchPrefix}, "/api/users/1", "/api/users", "/api/users", true},
+		{limitResource{Value: "/api/orders", Match: matchPrefix}, "/api/user", "", "", false},
+		//前缀匹配时优先匹配更长的模式
+		{limitResource{Values: map[string]int{"/api": 100, "/api/orders": 5}, Match: matchPrefix}, "/api/orders/1", "/api/orders", "/api/orders", true},
+		{limitResource{Value: ".json,.xml", Match: matchSuffix}, "/api/orders.xml", ".xml", ".xml", true},
+		{limitResource{Value: "^/api/v[0-9]+/orders$", Match: matchRegex}, "/api/v2/orders", "^/api/v[0-9]+/orders$", "^/api/v[0-9]+/orders$", true},
+		{limitResource{Value: "^/api/v[0-9]+/orders$", Match: matchRegex}, "/api/v2/orders/1", "", "", false},
+		//有捕获组时使用第一个捕获组作为限流key
+		{limitResource{Value: "^/users/([^/]+)/orders", Match: matchRegex}, "/users/nick/orders/1", "nick", "^/users/([^/]+)/orders", true},
+		//可选的捕获组没有匹配时使用模式作为限流key
+		{limitResource{Value: `^/u/(\d+)?x`, Match: matchRegex}, "/u/x", `^/u/(\d+)?x`, `^/u/(\d+)?x`, true},
+		{limitResource{Value: `^/u/(\d+)?x`, Match: matchRegex}, "/u/12x", "12", `^/u/(\d+)?x`, true},
+		//value为空或*时匹配任意非空值，使用实际的值作为限流key
+		{limitResource{Value: ""}, "user-1", "user-1", "*", true},
+		{limitResource{Value: "*"}, "user-2", "user-2", "*", true},
+		{limitResource{Value: "*"}, "", "", "", false},
+		{limitResource{Value: "admin,*"}, "admin", "admin", "admin", true},
+		{limitResource{Value: "/api/*/orders", Match: matchGlob}, "/api/v1/orders", "/api/*/orders", "/api/*/orders", true},
+		{limitResource{Value: "/api/v?.?", Match: matchGlob}, "/api/v1.2", "/api/v?.?", "/api/v?.?", true},
+		{limitResource{Value: "/api/v?.?", Match: matchGlob}, "/api/v12", "", "", false},
+		//正则和通配符不按逗号分隔
+		{limitResource{Value: "^/api/v[0-9]{1,2}/orders$", Match: matchRegex}, "/api/v1/orders", "^/api/v[0-9]{1,2}/orders$", "^/api/v[0-9]{1,2}/orders$", true},
+		{limitResource{Value: "^/api/v[0-9]{1,2}/orders$", Match: matchRegex}, "/api/v12}/orders", "", "", false},
+		{limitResource{Value: "/api/{a,b}", Match: matchGlob}, "/api/{a,b}", "/api/{a,b}", "/api/{a,b}", true},
+	}
+	for _, val := range list {
+		if err := val.resource.compile(); err != nil {
+			t.Fatalf("compile failed, %s", err.Error())
+		}
+		limitKey, pattern, matched := val.resource.matchValue(val.find)
+		if limitKey != val.limitKey || pattern != val.pattern || matched != val.expected {
+			t.Errorf("matchValue [%s] return: [%s %s %v], expected: [%s %s %v]", val.find, limitKey, pattern, matched, val.limitKey, val.pattern, val.expected)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	list := []struct {
+		resource limitResource
+		patterns int
+		expected string
+	}{
+		{limitResource{Value: "a,b"}, 2, ""},
+		{limitResource{Value: "a,b", Match: "PREFIX"}, 2, ""},
+		//正则中的逗号不作为分隔符
+		{limitResource{Value: "^/api/v[0-9]{1,2}/orders$", Match: matchRegex}, 1, ""},
+		{limitResource{Value: "^/api/(", Match: matchRegex}, 1, "LimitResourcesJson with invalid regex ^/api/(,error parsing regexp: missing closing ): `^/api/(`"},
+		{limitResource{Value: "a,b", Match: "contains"}, 2, "LimitResourcesJson with unsupported match contains"},
+	}
+	for _, val := range list {
+		err := val.resource.compile()
+		if (err == nil && val.expected != "") || (err != nil && err.Error() != val.expected) {
+			t.Errorf("compile return: [%v], expected: [%s]", err, val.expected)
+		}
+		if len(val.resource.patterns) != val.patterns {
+			t.Errorf("compile [%s] return %d patterns, expected: %d", val.resource.Value, len(val.resource.patterns), val.patterns)
+		}
+	}
+}
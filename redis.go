@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//redis客户端长时间未使用时关闭，配置变化后旧的客户端不会再被使用
+const redisClientExpire = 10 * time.Minute
+
+//检查并关闭长时间未使用的redis客户端的间隔
+const redisClientSweepInterval = time.Minute
+
+//进程内共享的redis客户端(连接池)，key为redis连接相关的配置
+var redisClientCache sync.Map
+
+//下次检查长时间未使用的redis客户端的时间戳(秒)
+var nextRedisClientSweep int64
+
+//解析后的redis TLS配置缓存，key为TLS相关的配置及证书文件的修改时间和大小，证书文件只在配置或文件变化时读取
+var redisTLSConfigCache = newBoundedCache(configCacheSize)
+
+//缓存的redis客户端
+type cachedRedisClient struct {
+	sync.Mutex
+	client   redis.UniversalClient
+	lastUsed int64 //上次使用的时间戳(秒)
+	closed   bool  //是否已被关闭，关闭后不能再使用
+}
+
+//获取共享的redis客户端，连接配置相同的请求及插件实例复用同一个连接池，配置变化时创建新的客户端
+func (conf Config) getRedisClient() redis.UniversalClient {
+	key := conf.getRedisClientKey()
+	now := time.Now().Unix()
+	//定期关闭长时间未使用的客户端，如配置变化后不再使用的旧连接池
+	if next := atomic.LoadInt64(&nextRedisClientSweep); now >= next && atomic.CompareAndSwapInt64(&nextRedisClientSweep, next, now+int64(redisClientSweepInterval/time.Second)) {
+		closeExpiredRedisClients(now)
+	}
+	for {
+		if cached, ok := redisClientCache.Load(key); ok {
+			if item := cached.(*cachedRedisClient); item.use(now) {
+				return item.client
+			}
+			//已被关闭并从缓存中删除，重新创建
+		}
+		item := &cachedRedisClient{client: conf.newRedisClient(), lastUsed: now}
+		cached, loaded := redisClientCache.LoadOrStore(key, item)
+		if !loaded {
+			return item.client
+		}
+		//并发创建时只保留一个，关闭多余的客户端
+		_ = item.client.Close()
+		if item := cached.(*cachedRedisClient); item.use(now) {
+			return item.client
+		}
+	}
+}
+
+//更新使用时间，客户端已被关闭时返回false
+func (item *cachedRedisClient) use(now int64) bool {
+	item.Lock()
+	defer item.Unlock()
+	if item.closed {
+		return false
+	}
+	item.lastUsed = now
+	return true
+}
+
+//获取redis连接相关配置组成的key
+func (conf Config) getRedisClientKey() string {
+	key, _ := json.Marshal([]interface{}{
+		conf.RedisMode, conf.RedisHost, conf.RedisPort, conf.RedisAuth, conf.RedisDB, conf.RedisTimeoutSecond,
+		conf.RedisClusterNodes, conf.RedisSentinelMaster, conf.RedisSentinelNodes, conf.RedisSentinelPassword,
+		conf.RedisPoolSize, conf.RedisMinIdleConns, conf.RedisIdleTimeoutSecond,
+		conf.RedisUsername, conf.getRedisTLSKey(),
+	})
+	return string(key)
+}
+
+//关闭长时间未使用的客户端，与更新使用时间互斥，不会关闭刚被获取的客户端
+func closeExpiredRedisClients(now int64) {
+	redisClientCache.Range(func(key, value interface{}) bool {
+		item := value.(*cachedRedisClient)
+		item.Lock()
+		defer item.Unlock()
+		if !item.closed && now-item.lastUsed > int64(redisClientExpire/time.Second) {
+			item.closed = true
+			redisClientCache.Delete(key)
+			_ = item.client.Close()
+		}
+		return true
+	})
+}
+
+//获取redis TLS相关配置组成的key，包含证书文件的修改时间和大小，证书文件更新或删除后重新读取并创建新的连接池
+func (conf Config) getRedisTLSKey() string {
+	if !conf.RedisTLS {
+		return ""
+	}
+	key, _ := json.Marshal([]interface{}{
+		conf.RedisTLSCaFile, conf.RedisTLSCertFile, conf.RedisTLSKeyFile, conf.RedisTLSServerName, conf.RedisTLSInsecureSkipVerify,
+		getFileVersion(conf.RedisTLSCaFile), getFileVersion(conf.RedisTLSCertFile), getFileVersion(conf.RedisTLSKeyFile),
+	})
+	return string(key)
+}
+
+//获取文件的修改时间和大小，文件不存在或不可读时返回错误信息
+func getFileVersion(path string) string {
+	if path == "" {
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err.Error()
+	}
+	return strconv.FormatInt(info.ModTime().UnixNano(), 10) + "-" + strconv.FormatInt(info.Size(), 10)
+}
+
+//获取redis TLS配置，没有开启TLS时返回nil，证书文件不可读或格式错误时返回错误
+func (conf Config) getRedisTLSConfig() (*tls.Config, error) {
+	if !conf.RedisTLS {
+		return nil, nil
+	}
+	key := conf.getRedisTLSKey()
+	if cached, ok := redisTLSConfigCache.Load(key); ok {
+		return cached.(*tls.Config), nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         conf.RedisTLSServerName,
+		InsecureSkipVerify: conf.RedisTLSInsecureSkipVerify,
+	}
+	if conf.RedisTLSCaFile != "" {
+		ca, err := ioutil.ReadFile(conf.RedisTLSCaFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("RedisTLSCaFile with unreadable file,%s", err.Error()))
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New(fmt.Sprintf("RedisTLSCaFile with no valid certificate %s", conf.RedisTLSCaFile))
+		}
+	}
+	if (conf.RedisTLSCertFile == "") != (conf.RedisTLSKeyFile == "") {
+		return nil, errors.New("RedisTLSCertFile and RedisTLSKeyFile must be configured together")
+	}
+	if conf.RedisTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.RedisTLSCertFile, conf.RedisTLSKeyFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("RedisTLSCertFile with invalid certificate or key,%s", err.Error()))
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	redisTLSConfigCache.Store(key, tlsConfig)
+	return tlsConfig, nil
+}
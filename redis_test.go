@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetRedisClient(t *testing.T) {
+	conf := getDefaultConf()
+	client := conf.getRedisClient()
+	if conf.getRedisClient() != client {
+		t.Errorf("getRedisClient with same config return a new client, expected reuse")
+	}
+	//与连接无关的配置变化不创建新的客户端
+	conf.QPS = 100
+	if conf.getRedisClient() != client {
+		t.Errorf("getRedisClient with changed QPS return a new client, expected reuse")
+	}
+	conf.RedisPoolSize = 5
+	poolClient := conf.getRedisClient()
+	if poolClient == client {
+		t.Errorf("getRedisClient with changed RedisPoolSize return the old client, expected a new one")
+	}
+	if err := poolClient.Ping(ctx).Err(); err != nil {
+		t.Errorf("ping failed, %s", err.Error())
+	}
+}
+
+func TestCloseExpiredRedisClients(t *testing.T) {
+	conf := getDefaultConf()
+	conf.RedisIdleTimeoutSecond = 60
+	client := conf.getRedisClient()
+	expireRedisClient(conf)
+	closeExpiredRedisClients(time.Now().Unix())
+	if _, ok := redisClientCache.Load(conf.getRedisClientKey()); ok {
+		t.Errorf("closeExpiredRedisClients did not remove the expired client")
+	}
+	if err := client.Ping(ctx).Err(); err == nil {
+		t.Errorf("ping with closed client success, expected error")
+	}
+	if conf.getRedisClient() == client {
+		t.Errorf("getRedisClient return the closed client, expected a new one")
+	}
+}
+
+//将客户端的使用时间改为已过期
+func expireRedisClient(conf *Config) {
+	cached, _ := redisClientCache.Load(conf.getRedisClientKey())
+	item := cached.(*cachedRedisClient)
+	item.Lock()
+	item.lastUsed = time.Now().Add(-2 * redisClientExpire).Unix()
+	item.Unlock()
+}
+
+func TestGetRedisClientSweepExpired(t *testing.T) {
+	conf := getDefaultConf()
+	conf.RedisMinIdleConns = 1
+	oldClient := conf.getRedisClient()
+	//配置变化后只使用新的客户端，旧的客户端过期后在获取客户端时关闭
+	conf.RedisMinIdleConns = 2
+	client := conf.getRedisClient()
+	oldConf := *conf
+	oldConf.RedisMinIdleConns = 1
+	expireRedisClient(&oldConf)
+	atomic.StoreInt64(&nextRedisClientSweep, 0)
+	if conf.getRedisClient() != client {
+		t.Errorf("getRedisClient with same config return a new client, expected reuse")
+	}
+	if _, ok := redisClientCache.Load(oldConf.getRedisClientKey()); ok {
+		t.Errorf("getRedisClient did not remove the expired client")
+	}
+	if err := oldClient.Ping(ctx).Err(); err == nil {
+		t.Errorf("ping with closed client success, expected error")
+	}
+	//已关闭但还在使用中的缓存项不会被返回
+	cached, _ := redisClientCache.Load(conf.getRedisClientKey())
+	item := cached.(*cachedRedisClient)
+	item.Lock()
+	item.closed = true
+	item.Unlock()
+	redisClientCache.Delete(conf.getRedisClientKey())
+	if item.use(time.Now().Unix()) {
+		t.Errorf("use with closed client return: [%v], expected: [%v]", true, false)
+	}
+	if conf.getRedisClient() == client {
+		t.Errorf("getRedisClient return the closed client, expected a new one")
+	}
+}
+
+//生成测试用的自签名证书及私钥文件
+func writeTestCertificate(t *testing.T, dir string) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis.test"},
+		DNSNames:              []string{"redis.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	_ = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestGetRedisTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+	list := []struct {
+		caFile   string
+		certFile string
+		keyFile  string
+		expected string
+	}{
+		{"", "", "", ""},
+		{certFile, certFile, keyFile, ""},
+		{filepath.Join(dir, "missing.pem"), "", "", "RedisTLSCaFile with unreadable file"},
+		{keyFile, "", "", "RedisTLSCaFile with no valid certificate " + keyFile},
+		{"", certFile, "", "RedisTLSCertFile and RedisTLSKeyFile must be configured together"},
+		{"", certFile, certFile, "RedisTLSCertFile with invalid certificate or key"},
+	}
+	for _, val := range list {
+		conf := getDefaultConf()
+		conf.RedisTLS = true
+		conf.RedisTLSServerName = "redis.test"
+		conf.RedisTLSCaFile = val.caFile
+		conf.RedisTLSCertFile = val.certFile
+		conf.RedisTLSKeyFile = val.keyFile
+		err := conf.checkConfig()
+		if val.expected == "" {
+			if err != nil {
+				t.Errorf("checkConfig with tls [%s %s %s] failed, %s", val.caFile, val.certFile, val.keyFile, err.Error())
+				continue
+			}
+			tlsConfig, _ := conf.getRedisTLSConfig()
+			if tlsConfig.ServerName != "redis.test" || (val.caFile != "" && tlsConfig.RootCAs == nil) || (val.certFile != "" && len(tlsConfig.Certificates) != 1) {
+				t.Errorf("getRedisTLSConfig with [%s %s %s] return unexpected config", val.caFile, val.certFile, val.keyFile)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), val.expected) {
+			t.Errorf("checkConfig with tls [%s %s %s] return: [%v], expected: [%s]", val.caFile, val.certFile, val.keyFile, err, val.expected)
+		}
+	}
+	//没有开启TLS时不读取证书文件
+	conf := getDefaultConf()
+	conf.RedisTLSCaFile = filepath.Join(dir, "missing.pem")
+	if tlsConfig, err := conf.getRedisTLSConfig(); tlsConfig != nil || err != nil {
+		t.Errorf("getRedisTLSConfig without RedisTLS return: [%v %v], expected: [nil nil]", tlsConfig, err)
+	}
+}
+
+func TestGetRedisTLSConfigWithChangedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+	conf := getDefaultConf()
+	conf.RedisTLS = true
+	conf.RedisTLSCaFile = certFile
+	conf.RedisTLSCertFile = certFile
+	conf.RedisTLSKeyFile = keyFile
+	if err := conf.checkConfig(); err != nil {
+		t.Fatalf("checkConfig with tls failed, %s", err.Error())
+	}
+	tlsConfig, _ := conf.getRedisTLSConfig()
+	clientKey := conf.getRedisClientKey()
+	//证书轮换后重新读取，并使用新的连接池
+	time.Sleep(10 * time.Millisecond)
+	writeTestCertificate(t, dir)
+	rotated, err := conf.getRedisTLSConfig()
+	if err != nil || rotated == tlsConfig || string(rotated.Certificates[0].Certificate[0]) == string(tlsConfig.Certificates[0].Certificate[0]) {
+		t.Errorf("getRedisTLSConfig after rotating certificate return cached config, err: %v", err)
+	}
+	if conf.getRedisClientKey() == clientKey {
+		t.Errorf("getRedisClientKey after rotating certificate return the old key")
+	}
+	//证书文件删除后checkConfig返回错误
+	_ = os.Remove(certFile)
+	expected := "RedisTLSCaFile with unreadable file"
+	if err := conf.checkConfig(); err == nil || !strings.HasPrefix(err.Error(), expected) {
+		t.Errorf("checkConfig after removing certificate return: [%v], expected: [%s]", err, expected)
+	}
+}
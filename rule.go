@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Kong/go-pdk"
+	"strconv"
+)
+
+//是否是规则组(all、any、not)，否则为叶子规则
+func (resource limitResource) isGroup() bool {
+	return resource.All != nil || resource.Any != nil || resource.Not != nil
+}
+
+//校验并编译规则树，path为规则在树中的位置(数组形式以下标开头，如[1].all[0])，用于错误提示
+func (conf Config) checkResource(resource *limitResource, path string) error {
+	return conf.checkResourceWithNot(resource, path, false)
+}
+
+//校验并编译规则树，inNot表示规则在not下，not不产生限流key，其下的叶子规则不能配置限制
+func (conf Config) checkResourceWithNot(resource *limitResource, path string, inNot bool) error {
+	if resource.isGroup() {
+		groups := 0
+		for _, exist := range []bool{resource.All != nil, resource.Any != nil, resource.Not != nil} {
+			if exist {
+				groups++
+			}
+		}
+		if groups > 1 || resource.Type != "" || resource.Key != "" {
+			return withRulePath(errors.New("LimitResourcesJson with more than one of all, any, not and type in one rule"), path)
+		}
+		//规则组只用于组合子规则，限制及匹配值需要配置在叶子规则上
+		if resource.QPS != 0 || resource.Second != 0 || resource.Minute != 0 || resource.Hour != 0 || resource.Day != 0 || resource.Month != 0 ||
+			resource.Value != "" || resource.Values != nil || resource.Match != "" {
+			return withRulePath(errors.New("LimitResourcesJson with limit, value or match on group"), path)
+		}
+		if resource.Not != nil {
+			return conf.checkResourceWithNot(resource.Not, joinRulePath(path, "not"), true)
+		}
+		name, children := "all", resource.All
+		if resource.Any != nil {
+			name, children = "any", resource.Any
+		}
+		if len(children) == 0 {
+			return withRulePath(errors.New(fmt.Sprintf("LimitResourcesJson with empty %s", name)), path)
+		}
+		for i := range children {
+			if err := conf.checkResourceWithNot(&children[i], joinRulePath(path, name+"["+strconv.Itoa(i)+"]"), inNot); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	//value为空表示匹配任意值
+	if resource.Type == "" || resource.Key == "" {
+		return withRulePath(errors.New("LimitResourcesJson with empty value"), path)
+	}
+	if resource.QPS < 0 || resource.Second < 0 || resource.Minute < 0 || resource.Hour < 0 || resource.Day < 0 || resource.Month < 0 {
+		return withRulePath(errors.New("LimitResourcesJson with negative limit"), path)
+	}
+	//not下的规则只用于排除，配置的限制不会生效
+	if inNot && (resource.hasLimit() || resource.Values != nil) {
+		return withRulePath(errors.New("LimitResourcesJson with limit or values under not"), path)
+	}
+	//values中的模式会覆盖value，同时配置时value不生效
+	if resource.Value != "" && resource.Values != nil {
+		return withRulePath(errors.New("LimitResourcesJson with both value and values"), path)
+	}
+	for _, limit := range resource.Values {
+		if limit < 0 {
+			return withRulePath(errors.New("LimitResourcesJson with negative limit"), path)
+		}
+	}
+	if (conf.Algorithm == algorithmTokenBucket || conf.Algorithm == algorithmGCRA) && (resource.Minute > 0 || resource.Hour > 0 || resource.Day > 0 || resource.Month > 0) {
+		return withRulePath(errors.New(fmt.Sprintf("LimitResourcesJson with minute, hour, day or month limit which is not supported by %s algorithm", conf.Algorithm)), path)
+	}
+	return withRulePath(resource.compile(), path)
+}
+
+//拼接规则路径
+func joinRulePath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+//在错误信息中加上规则的位置，对象形式的根规则没有位置
+func withRulePath(err error, path string) error {
+	if err == nil || path == "" {
+		return err
+	}
+	return errors.New(err.Error() + " at " + path)
+}
+
+//规则树是否匹配，返回匹配到的限流key及叶子规则，all需要全部匹配，any匹配到一个即可，not取反且不产生限流key
+func (conf Config) matchResource(kong *pdk.PDK, resource limitResource) (limitKeys []string, matchedResources []limitResource, matched bool) {
+	switch {
+	case resource.Not != nil:
+		_, _, matched = conf.matchResource(kong, *resource.Not)
+		return nil, nil, !matched
+	case resource.All != nil:
+		for _, child := range resource.All {
+			keys, resources, matched := conf.matchResource(kong, child)
+			if !matched {
+				return nil, nil, false
+			}
+			limitKeys = append(limitKeys, keys...)
+			matchedResources = append(matchedResources, resources...)
+		}
+		return limitKeys, matchedResources, true
+	case resource.Any != nil:
+		for _, child := range resource.Any {
+			if keys, resources, matched := conf.matchResource(kong, child); matched {
+				return keys, resources, true
+			}
+		}
+		return nil, nil, false
+	default:
+		rateLimitValue, pattern, matched, tooLarge := conf.matchRateLimitValue(kong, resource)
+		if !matched {
+			return nil, nil, false
+		}
+		//使用匹配到的值对应的限制
+		matchedResource := resource.withValueLimit(pattern)
+		matchedResource.multipartTooLarge = tooLarge
+		return []string{rateLimitValue}, []limitResource{matchedResource}, true
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+)
+
+//(header:X-Tenant=gold AND method=POST) OR path=/admin
+const ruleTreeJson = `
+{"any": [
+	{"all": [
+		{"type": "header", "key": "X-Tenant", "value": "gold"},
+		{"type": "method", "key": "method", "value": "POST"}
+	]},
+	{"type": "path", "key": "path", "value": "/admin", "match": "prefix"}
+]}
+`
+
+func TestParseLimitResourcesWithRuleTree(t *testing.T) {
+	list := []struct {
+		json     string
+		expected string
+	}{
+		{ruleTreeJson, ""},
+		{`{"not": {"type": "header", "key": "X-Internal", "value": "1"}}`, ""},
+		{`{"any": [{"all": [{"type": "header", "key": ""}]}]}`, "LimitResourcesJson with empty value at any[0].all[0]"},
+		{`{"any": []}`, "LimitResourcesJson with empty any"},
+		{`[{"type": "path", "key": "path"}, {"all": []}]`, "LimitResourcesJson with empty all at [1]"},
+		{`[{"type": "path", "key": "path"}, {"all": [{"type": "header", "key": ""}]}]`, "LimitResourcesJson with empty value at [1].all[0]"},
+		{`[{"type": "path", "key": "path"}, {"type": "header", "key": ""}]`, "LimitResourcesJson with empty value at [1]"},
+		{`{"all": [{"type": "header", "key": "X-Tenant"}, {"not": {"type": "path", "key": "path", "value": "(", "match": "regex"}}]}`, "LimitResourcesJson with invalid regex (,error parsing regexp: missing closing ): `(` at all[1].not"},
+		{`{"all": [{"type": "header", "key": "X-Tenant", "any": [{"type": "path", "key": "path"}]}]}`, "LimitResourcesJson with more than one of all, any, not and type in one rule at all[0]"},
+		{`{"any": [{"type": "header", "key": "X-Tenant", "qps": -1}]}`, "LimitResourcesJson with negative limit at any[0]"},
+		{`{"all": [{"type": "header", "key": "X-Tenant"}], "qps": 100}`, "LimitResourcesJson with limit, value or match on group"},
+		{`{"any": [{"all": [{"type": "header", "key": "X-Tenant"}], "values": {"gold": 10}}]}`, "LimitResourcesJson with limit, value or match on group at any[0]"},
+		{`[{"not": {"type": "header", "key": "X-Tenant"}, "match": "prefix"}]`, "LimitResourcesJson with limit, value or match on group at [0]"},
+		{`{"any": [{"type": "header", "key": "X-Tenant", "value": "a", "values": {"b": 5}}]}`, "LimitResourcesJson with both value and values at any[0]"},
+		{`{"all": [{"type": "header", "key": "X-Tenant"}, {"not": {"type": "path", "key": "path", "value": "/health", "qps": 10}}]}`, "LimitResourcesJson with limit or values under not at all[1].not"},
+		{`[{"not": {"any": [{"type": "path", "key": "path"}, {"type": "header", "key": "X-Internal", "values": {"1": 5}}]}}]`, "LimitResourcesJson with limit or values under not at [0].not.any[1]"},
+	}
+	for _, val := range list {
+		conf := getDefaultConf()
+		conf.LimitResourcesJson = val.json
+		_, err := conf.parseLimitResources()
+		actual := ""
+		if err != nil {
+			actual = err.Error()
+		}
+		if actual != val.expected {
+			t.Errorf("parseLimitResources [%s] return: [%s], expected: [%s]", val.json, actual, val.expected)
+		}
+	}
+}
+
+func TestCheckNeedRateLimitWithRuleTree(t *testing.T) {
+	list := []struct {
+		tenant   string
+		method   string
+		path     string
+		limitKey string
+		matched  bool
+	}{
+		{"gold", "POST", "/orders", "gold:POST", true},
+		{"gold", "GET", "/orders", "", false},
+		{"silver", "POST", "/orders", "", false},
+		{"silver", "GET", "/admin/users", "/admin", true},
+	}
+	for _, val := range list {
+		kong := newMockPdk(map[string]interface{}{
+			"kong.request.get_header": val.tenant,
+			"kong.request.get_method": val.method,
+			"kong.request.get_path":   val.path,
+		})
+		conf := getDefaultConf()
+		conf.LimitResourcesJson = ruleTreeJson
+		limitKey, _, matched := conf.checkNeedRateLimit(kong)
+		if limitKey != val.limitKey || matched != val.matched {
+			t.Errorf("checkNeedRateLimit [%s %s %s] return: [%s %v], expected: [%s %v]", val.tenant, val.method, val.path, limitKey, matched, val.limitKey, val.matched)
+		}
+	}
+	//not不产生限流key
+	kong := newMockPdk(map[string]interface{}{
+		"kong.request.get_header": "0",
+		"kong.request.get_path":   "/orders",
+	})
+	conf := getDefaultConf()
+	conf.Path = "/orders"
+	conf.LimitResourcesJson = `{"not": {"type": "header", "key": "X-Internal", "value": "1"}}`
+	if limitKey, _, matched := conf.checkNeedRateLimit(kong); limitKey != "/orders" || !matched {
+		t.Errorf("checkNeedRateLimit with not return: [%s %v], expected: [%s %v]", limitKey, matched, "/orders", true)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+//限流窗口:秒，key中沿用原来的qps
+const windowSecond = rateLimitType
+
+//限流窗口:分钟
+const windowMinute = "minute"
+
+//限流窗口:小时
+const windowHour = "hour"
+
+//限流窗口:天
+const windowDay = "day"
+
+//限流窗口:月，按自然月(UTC)计算
+const windowMonth = "month"
+
+//限流窗口
+type limitWindow struct {
+	name  string    //窗口名称
+	limit int       //窗口内允许的请求数
+	start time.Time //当前窗口开始时间
+	end   time.Time //当前窗口结束时间
+}
+
+//获取配置的所有限流窗口，按窗口从小到大排列
+func (conf Config) getLimitWindows(now time.Time) []limitWindow {
+	limits := []struct {
+		name  string
+		limit int
+	}{
+		{windowSecond, conf.getSecondLimit()},
+		{windowMinute, conf.Minute},
+		{windowHour, conf.Hour},
+		{windowDay, conf.Day},
+		{windowMonth, conf.Month},
+	}
+	var windows []limitWindow
+	for _, item := range limits {
+		if item.limit <= 0 {
+			continue
+		}
+		start, end := getWindowBounds(item.name, now)
+		windows = append(windows, limitWindow{
+			name:  item.name,
+			limit: item.limit,
+			start: start,
+			end:   end,
+		})
+	}
+	return windows
+}
+
+//获取每秒的限制，Second为空时使用QPS
+func (conf Config) getSecondLimit() int {
+	if conf.Second > 0 {
+		return conf.Second
+	}
+	return conf.QPS
+}
+
+//是否配置了秒以外的窗口
+func (conf Config) hasLongWindow() bool {
+	return conf.Minute > 0 || conf.Hour > 0 || conf.Day > 0 || conf.Month > 0
+}
+
+//获取当前时间所在窗口的开始和结束时间
+func getWindowBounds(name string, now time.Time) (start time.Time, end time.Time) {
+	var size int64
+	switch name {
+	case windowMinute:
+		size = 60
+	case windowHour:
+		size = 3600
+	case windowDay:
+		size = 86400
+	case windowMonth:
+		utc := now.UTC()
+		start = time.Date(utc.Year(), utc.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	default:
+		size = 1
+	}
+	unix := now.Unix()
+	start = time.Unix(unix-unix%size, 0)
+	return start, start.Add(time.Duration(size) * time.Second)
+}
+
+//窗口长度
+func (window limitWindow) duration() time.Duration {
+	return window.end.Sub(window.start)
+}
+
+//上一个窗口的开始时间
+func (window limitWindow) previousStart() time.Time {
+	start, _ := getWindowBounds(window.name, window.start.Add(-time.Second))
+	return start
+}
+
+//返回给客户端的header名称，秒窗口沿用X-Rate-Limiting-Limit-QPS
+func (window limitWindow) limitHeader() string {
+	if window.name == windowSecond {
+		return "X-Rate-Limiting-Limit-QPS"
+	}
+	return "X-Rate-Limiting-Limit-" + strings.ToUpper(window.name[:1]) + window.name[1:]
+}
+
+//根据本次请求之前已使用的数量计算剩余数量
+func (window limitWindow) getUsageResult(usage int64, reset time.Duration) (result limitResult) {
+	result.window = window
+	result.reset = reset
+	result.remaining = window.limit - int(usage)
+	if result.remaining <= 0 {
+		result.stop = true
+		result.remaining = 0
+	} else {
+		//friendly show
+		result.remaining -= 1
+	}
+	return result
+}
+
+//合并多个窗口的结果:有窗口超限则限流并返回最晚重置的超限窗口，否则返回剩余数量最少的窗口
+func mergeLimitResults(results []limitResult) (tightest limitResult) {
+	for i, result := range results {
+		if i == 0 {
+			tightest = result
+			continue
+		}
+		if result.stop != tightest.stop {
+			if result.stop {
+				tightest = result
+			}
+			continue
+		}
+		if result.stop {
+			if result.reset > tightest.reset {
+				tightest = result
+			}
+			continue
+		}
+		if result.remaining < tightest.remaining {
+			tightest = result
+		}
+	}
+	return tightest
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"github.com/Kong/go-pdk"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGetWindowBounds(t *testing.T) {
+	now := time.Date(2020, 9, 14, 7, 9, 16, 500, time.UTC)
+	list := []struct {
+		window string
+		start  time.Time
+		end    time.Time
+	}{
+		{windowSecond, time.Date(2020, 9, 14, 7, 9, 16, 0, time.UTC), time.Date(2020, 9, 14, 7, 9, 17, 0, time.UTC)},
+		{windowMinute, time.Date(2020, 9, 14, 7, 9, 0, 0, time.UTC), time.Date(2020, 9, 14, 7, 10, 0, 0, time.UTC)},
+		{windowHour, time.Date(2020, 9, 14, 7, 0, 0, 0, time.UTC), time.Date(2020, 9, 14, 8, 0, 0, 0, time.UTC)},
+		{windowDay, time.Date(2020, 9, 14, 0, 0, 0, 0, time.UTC), time.Date(2020, 9, 15, 0, 0, 0, 0, time.UTC)},
+		{windowMonth, time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, val := range list {
+		start, end := getWindowBounds(val.window, now)
+		if !start.Equal(val.start) || !end.Equal(val.end) {
+			t.Errorf("getWindowBounds [%s] return: [%v %v], expected: [%v %v]", val.window, start, end, val.start, val.end)
+		}
+	}
+}
+
+func TestGetLimitWindows(t *testing.T) {
+	conf := getDefaultConf()
+	conf.QPS = 10
+	conf.Minute = 500
+	conf.Day = 20000
+	windows := conf.getLimitWindows(time.Now())
+	expected := []struct {
+		name  string
+		limit int
+	}{
+		{windowSecond, 10},
+		{windowMinute, 500},
+		{windowDay, 20000},
+	}
+	if len(windows) != len(expected) {
+		t.Fatalf("getLimitWindows return %d windows, expected: %d", len(windows), len(expected))
+	}
+	for i, val := range expected {
+		if windows[i].name != val.name || windows[i].limit != val.limit {
+			t.Errorf("getLimitWindows return: [%s %d], expected: [%s %d]", windows[i].name, windows[i].limit, val.name, val.limit)
+		}
+	}
+	//Second优先于QPS
+	conf.Second = 20
+	windows = conf.getLimitWindows(time.Now())
+	if windows[0].limit != 20 {
+		t.Errorf("getLimitWindows return second limit: [%d], expected: [%d]", windows[0].limit, 20)
+	}
+}
+
+func TestMergeLimitResults(t *testing.T) {
+	second := limitWindow{name: windowSecond, limit: 10}
+	minute := limitWindow{name: windowMinute, limit: 500}
+	day := limitWindow{name: windowDay, limit: 20000}
+	list := []struct {
+		results  []limitResult
+		expected string
+	}{
+		{
+			results: []limitResult{
+				{window: second, remaining: 9},
+				{window: minute, remaining: 3},
+				{window: day, remaining: 100},
+			},
+			expected: windowMinute,
+		},
+		{
+			results: []limitResult{
+				{window: second, remaining: 0, reset: time.Second, stop: true},
+				{window: minute, remaining: 3},
+				{window: day, remaining: 0, reset: time.Hour, stop: true},
+			},
+			expected: windowDay,
+		},
+	}
+	for _, val := range list {
+		actual := mergeLimitResults(val.results)
+		if actual.window.name != val.expected {
+			t.Errorf("mergeLimitResults return: [%s], expected: [%s]", actual.window.name, val.expected)
+		}
+	}
+}
+
+func TestLimitHeader(t *testing.T) {
+	if header := (limitWindow{name: windowSecond}).limitHeader(); header != "X-Rate-Limiting-Limit-QPS" {
+		t.Errorf("limitHeader return: [%s], expected: [%s]", header, "X-Rate-Limiting-Limit-QPS")
+	}
+	if header := (limitWindow{name: windowMinute}).limitHeader(); header != "X-Rate-Limiting-Limit-Minute" {
+		t.Errorf("limitHeader return: [%s], expected: [%s]", header, "X-Rate-Limiting-Limit-Minute")
+	}
+}
+
+func TestCheckConfigWithWindows(t *testing.T) {
+	conf := getDefaultConf()
+	conf.QPS = 0
+	conf.Minute = 500
+	if err := conf.checkConfig(); err != nil {
+		t.Errorf("checkConfig with only Minute failed, %s", err.Error())
+	}
+	conf.Algorithm = algorithmGCRA
+	expected := "Minute, Hour, Day and Month are not supported by gcra algorithm"
+	if err := conf.checkConfig(); err == nil || err.Error() != expected {
+		t.Errorf("checkConfig return: [%v], expected: [%s]", err, expected)
+	}
+}
+
+func TestGetRemainingAndIncrWithWindows(t *testing.T) {
+	kong := &pdk.PDK{}
+	now := time.Now()
+	for _, algorithm := range []string{algorithmFixedWindow, algorithmSlidingWindowCounter, algorithmSlidingWindowLog} {
+		conf := getDefaultConf()
+		conf.QPS = 5
+		conf.Minute = 3
+		conf.Algorithm = algorithm
+		identifier := "windows-" + strconv.FormatInt(now.UnixNano(), 10)
+		expected := []struct {
+			window    string
+			remaining int
+			stop      bool
+		}{
+			{windowMinute, 2, false},
+			{windowMinute, 1, false},
+			{windowMinute, 0, false},
+			{windowMinute, 0, true},
+		}
+		for i, val := range expected {
+			result, err := conf.getRemainingAndIncr(kong, identifier, now)
+			if err != nil {
+				t.Fatalf("getRemainingAndIncr with algorithm [%s] failed, %s", algorithm, err.Error())
+			}
+			if result.window.name != val.window || result.remaining != val.remaining || result.stop != val.stop {
+				t.Errorf("getRemainingAndIncr with algorithm [%s] request %d return: [%s %v %v], expected: [%s %v %v]", algorithm, i, result.window.name, result.remaining, result.stop, val.window, val.remaining, val.stop)
+			}
+		}
+	}
+}